@@ -14,6 +14,10 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		validate(os.Args[2:])
+	}
+
 	flag.Parse()
 
 	if *version {
@@ -34,6 +38,31 @@ func main() {
 		panic(e)
 	}
 
+	if e := watcher.ValidateStdout(); e != nil {
+		panic(e)
+	}
+
+	if e := watcher.ValidateCheckpoint(); e != nil {
+		panic(e)
+	}
+
 	watcher.PromServer()
 	watcher.WatchStart(appConf)
 }
+
+// validate : `kube-event-watcher validate -config file` で設定fileの検証だけしてexitする。CIで使う想定
+func validate(args []string) {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		os.Exit(2)
+	}
+	warns, err := watcher.ValidateConfig()
+	for _, w := range warns {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("config is valid")
+	os.Exit(0)
+}
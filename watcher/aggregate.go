@@ -0,0 +1,157 @@
+package watcher
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// aggregation は同じobjectとreasonのeventをまとめる時間。最初のeventはすぐに送り、
+// それ以降の発生はwindowの終わりに「N回発生した」という1つの通知にまとめる
+type aggregation struct {
+	Window string `yaml:"window"`
+}
+
+func (a aggregation) window() time.Duration {
+	d, _ := time.ParseDuration(a.Window)
+	return d
+}
+
+func validateAggregation(a aggregation) []string {
+	if a.Window == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(a.Window)
+	if err != nil {
+		return []string{fmt.Sprintf("aggregation.window: %s", err)}
+	}
+	if d <= 0 {
+		return []string{fmt.Sprintf("aggregation.window: must be positive, got %q", a.Window)}
+	}
+	return nil
+}
+
+// aggregator はcontrollerごとにwindowの中の発生回数を数える
+type aggregator struct {
+	window time.Duration
+	mu     sync.Mutex
+	groups map[string]*aggregateGroup
+	// counts はevent名ごとの最後のcount。MODIFIEDで増えた分を発生回数にする
+	counts *eventCounts
+	// deliver はまとめた通知を送る。eventと同じように失敗したら送り直す
+	deliver func(key string, output string, overwrite bool, send func() error)
+}
+
+// aggregateGroup はinvolvedObjectとreasonごとの集計
+type aggregateGroup struct {
+	event *v1.Event
+	conf  slackConfig
+	since time.Time
+	count int32
+	timer *time.Timer
+}
+
+func newAggregator(a aggregation) *aggregator {
+	if a.window() <= 0 {
+		return nil
+	}
+	return &aggregator{
+		window: a.window(),
+		groups: map[string]*aggregateGroup{},
+		counts: newEventCounts(),
+	}
+}
+
+func aggregateKey(e *v1.Event) string {
+	o := e.InvolvedObject
+	return fmt.Sprintf("%s/%s/%s/%s/%s", o.Kind, o.Namespace, o.Name, o.UID, e.Reason)
+}
+
+// add はeventを集計する。windowの最初のeventならfalseを返し、すぐに送る
+func (a *aggregator) add(e *v1.Event, conf slackConfig) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := aggregateKey(e)
+	now := time.Now()
+	n := a.counts.delta(e.Namespace+"/"+e.Name, e.Count, now)
+	g, ok := a.groups[key]
+	if !ok {
+		g = &aggregateGroup{since: now}
+		g.timer = time.AfterFunc(a.window, func() { a.flush(key) })
+		a.groups[key] = g
+		return false
+	}
+	g.count += int32(n)
+	g.event = e
+	g.conf = conf
+	return true
+}
+
+// flush はwindowの間の発生回数を送る。発生していなければ集計をやめ、次のeventはすぐに送る
+func (a *aggregator) flush(key string) {
+	a.mu.Lock()
+	g, ok := a.groups[key]
+	if !ok {
+		a.mu.Unlock()
+		return
+	}
+	if g.count == 0 {
+		delete(a.groups, key)
+		a.mu.Unlock()
+		return
+	}
+	e, conf, count, since := g.event, g.conf, g.count, g.since
+	g.count = 0
+	g.since = time.Now()
+	g.timer = time.AfterFunc(a.window, func() { a.flush(key) })
+	a.mu.Unlock()
+
+	// slackUpdateがupdateなら最初のmessageを最新のeventで更新する
+	var msg interface{} = aggregateMessage(e, count, time.Since(since))
+	if conf.Update == slackUpdateMessage {
+		msg = e
+	}
+	send := func() error { return sendToSlack(e.Namespace+"/"+e.Name, msg, "updated", e.Type, conf) }
+	a.deliver("aggregate/"+key, outputSlack, conf.Update == slackUpdateMessage, send)
+}
+
+// stop は集計中の発生回数を送ってから止める
+func (a *aggregator) stop() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	var keys []string
+	for key, g := range a.groups {
+		g.timer.Stop()
+		keys = append(keys, key)
+	}
+	a.mu.Unlock()
+	for _, key := range keys {
+		a.flush(key)
+	}
+	a.mu.Lock()
+	for _, g := range a.groups {
+		g.timer.Stop()
+	}
+	a.groups = map[string]*aggregateGroup{}
+	a.mu.Unlock()
+}
+
+func aggregateMessage(e *v1.Event, count int32, d time.Duration) string {
+	o := e.InvolvedObject
+	return fmt.Sprintf("%s %s/%s %s happened %d more times in the last %s\nlast message: %s",
+		o.Kind, o.Namespace, o.Name, e.Reason, count, humanDuration(d), e.Message)
+}
+
+func humanDuration(d time.Duration) string {
+	if d >= time.Minute {
+		return fmt.Sprintf("%d minutes", int(d.Round(time.Minute)/time.Minute))
+	}
+	return fmt.Sprintf("%d seconds", int(d.Round(time.Second)/time.Second))
+}
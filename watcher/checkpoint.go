@@ -0,0 +1,224 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultCatchUpWindow = 10 * time.Minute
+	// checkpointFlushInterval ごとに変更があればcheckpointを書き出す
+	checkpointFlushInterval = 5 * time.Second
+	checkpointConfigMapKey  = "checkpoint.json"
+)
+
+var (
+	checkpointFile      = flag.String("checkpointFile", "", "Path of file to persist delivered events, to resume from it on restart.")
+	checkpointConfigMap = flag.String("checkpointConfigMap", "", "ConfigMap to persist delivered events as namespace/name, to resume from it on restart.")
+	catchUpWindow       = flag.Duration("catchUpWindow", defaultCatchUpWindow, "With checkpoint, events which happened within this window and are not delivered yet are delivered on start.")
+)
+
+// checkpointEntry はentryごとに送ったeventのcountと最後の発生時刻
+type checkpointEntry struct {
+	Count int32     `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+// checkpointBackend はcheckpointの保存先
+type checkpointBackend interface {
+	load() ([]byte, error)
+	save([]byte) error
+	String() string
+}
+
+// checkpoint は送ったeventの記録。keyはentryの名前とeventのUID
+// 起動時にcatchUpWindowの中で送っていないeventを送り、送ったeventは送り直さない
+type checkpoint struct {
+	backend checkpointBackend
+	mu      sync.Mutex
+	entries map[string]checkpointEntry
+	dirty   bool
+}
+
+// deliveryCheckpoint は-checkpointFileか-checkpointConfigMapの時だけ作られる
+var deliveryCheckpoint *checkpoint
+
+func checkpointEnabled() bool {
+	return *checkpointFile != "" || *checkpointConfigMap != ""
+}
+
+// ValidateCheckpoint : checkpointのflagの検証
+func ValidateCheckpoint() error {
+	if *checkpointFile != "" && *checkpointConfigMap != "" {
+		return errors.New("checkpoint error: only one of checkpointFile and checkpointConfigMap can be set")
+	}
+	if *checkpointConfigMap != "" && len(strings.Split(*checkpointConfigMap, "/")) != 2 {
+		return fmt.Errorf("checkpoint error: checkpointConfigMap must be namespace/name, got %q", *checkpointConfigMap)
+	}
+	if *catchUpWindow <= 0 {
+		return fmt.Errorf("checkpoint error: catchUpWindow must be positive, got %s", *catchUpWindow)
+	}
+	return nil
+}
+
+// startCheckpoint はcheckpointを読み込んで、定期的に書き出す
+func startCheckpoint(client kubernetes.Interface, stopCh chan struct{}) error {
+	if !checkpointEnabled() {
+		return nil
+	}
+	var backend checkpointBackend = fileCheckpoint(*checkpointFile)
+	if *checkpointConfigMap != "" {
+		nn := strings.Split(*checkpointConfigMap, "/")
+		backend = &configMapCheckpoint{client: client, namespace: nn[0], name: nn[1]}
+	}
+	cp := &checkpoint{backend: backend, entries: map[string]checkpointEntry{}}
+	buf, err := backend.load()
+	if err != nil {
+		return fmt.Errorf("checkpoint error: %s: %s", backend, err)
+	}
+	if len(buf) > 0 {
+		if err := json.Unmarshal(buf, &cp.entries); err != nil {
+			return fmt.Errorf("checkpoint error: %s: %s", backend, err)
+		}
+	}
+	cp.prune(time.Now())
+	glog.Infof("%d delivered events loaded from checkpoint %s", len(cp.entries), backend)
+	deliveryCheckpoint = cp
+	go wait.Until(cp.flush, checkpointFlushInterval, stopCh)
+	return nil
+}
+
+func checkpointKey(entry string, e *v1.Event) string {
+	return entry + "/" + string(e.UID)
+}
+
+// pending はeventを送る必要があるかどうか。送ったcountより増えていて、catchUpWindowの中で発生したもの
+func (cp *checkpoint) pending(entry string, e *v1.Event) bool {
+	if time.Since(eventTime(e)) > *catchUpWindow {
+		return false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	d, ok := cp.entries[checkpointKey(entry, e)]
+	return !ok || e.Count > d.Count
+}
+
+// done はeventを送ったことを記録する
+func (cp *checkpoint) done(entry string, e *v1.Event) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.entries[checkpointKey(entry, e)] = checkpointEntry{Count: e.Count, Last: eventTime(e)}
+	cp.dirty = true
+}
+
+// prune はcatchUpWindowより前のeventを消す。そのようなeventは送らないので記録もいらない
+func (cp *checkpoint) prune(now time.Time) {
+	for k, d := range cp.entries {
+		if now.Sub(d.Last) > *catchUpWindow {
+			delete(cp.entries, k)
+			cp.dirty = true
+		}
+	}
+}
+
+func (cp *checkpoint) flush() {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	cp.prune(time.Now())
+	if !cp.dirty {
+		cp.mu.Unlock()
+		return
+	}
+	buf, err := json.Marshal(cp.entries)
+	cp.dirty = false
+	cp.mu.Unlock()
+	if err == nil {
+		err = cp.backend.save(buf)
+	}
+	if err != nil {
+		glog.Errorf("Error save checkpoint %s : %s\n", cp.backend, err)
+		cp.mu.Lock()
+		cp.dirty = true
+		cp.mu.Unlock()
+	}
+}
+
+// fileCheckpoint はlocal fileに保存する
+type fileCheckpoint string
+
+func (f fileCheckpoint) String() string {
+	return string(f)
+}
+
+func (f fileCheckpoint) load() ([]byte, error) {
+	buf, err := ioutil.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return buf, err
+}
+
+func (f fileCheckpoint) save(buf []byte) error {
+	return writeFileAtomic(string(f), buf)
+}
+
+// configMapCheckpoint はConfigMapに保存する。なければ作る
+type configMapCheckpoint struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func (c *configMapCheckpoint) String() string {
+	return fmt.Sprintf("ConfigMap %s/%s", c.namespace, c.name)
+}
+
+func (c *configMapCheckpoint) load() ([]byte, error) {
+	cm, err := c.client.CoreV1().ConfigMaps(c.namespace).Get(context.TODO(), c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(cm.Data[checkpointConfigMapKey]), nil
+}
+
+func (c *configMapCheckpoint) save(buf []byte) error {
+	cms := c.client.CoreV1().ConfigMaps(c.namespace)
+	cm, err := cms.Get(context.TODO(), c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: c.name, Namespace: c.namespace},
+			Data:       map[string]string{checkpointConfigMapKey: string(buf)},
+		}
+		_, err = cms.Create(context.TODO(), cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[checkpointConfigMapKey] = string(buf)
+	_, err = cms.Update(context.TODO(), cm, metav1.UpdateOptions{})
+	return err
+}
@@ -3,24 +3,94 @@ package watcher
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strings"
 	"text/template"
 
 	"github.com/golang/glog"
 	"github.com/mitchellh/go-homedir"
 	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
 )
 
 // Config はファイルで読み込む設定の型
 type Config struct {
-	Namespace      string          `yaml:"namespace"`
-	WatchEvent     watchEvent      `yaml:"watchEvent"`
-	FieldSelectors []fieldSelector `yaml:"fieldSelectors"`
-	ExtraFilter    extraFilter     `yaml:"extraFilter"`
-	Channel        string          `yaml:"channel"`
-	LogStream      string          `yaml:"logStream"`
+	Namespace string `yaml:"namespace"`
+	// namespaceの代わりに複数のnamespaceやlabel selectorで指定する。selectorはNamespaceの変更に追従する
+	Namespaces        []string        `yaml:"namespaces"`
+	NamespaceSelector string          `yaml:"namespaceSelector"`
+	WatchEvent        watchEvent      `yaml:"watchEvent"`
+	FieldSelectors    []fieldSelector `yaml:"fieldSelectors"`
+	ExtraFilter       extraFilter     `yaml:"extraFilter"`
+	Channel           string          `yaml:"channel"`
+	LogStream         string          `yaml:"logStream"`
+	// entryごとにtemplateを上書きする。inlineのtemplateがfileより優先
+	SlackTemplate      string   `yaml:"slackTemplate"`
+	SlackTemplateFile  string   `yaml:"slackTemplateFile"`
+	CWLogsTemplate     string   `yaml:"cwlogsTemplate"`
+	CWLogsTemplateFile string   `yaml:"cwlogsTemplateFile"`
+	Outputs            []string `yaml:"outputs"`
+	// Routes はmatchしたeventのchannelとlogStreamを上書きする。最初にmatchしたrouteを使う
+	Routes []route `yaml:"routes"`
+	// Schedules はmaintenanceやquiet hoursの時間帯
+	Schedules []schedule `yaml:"schedules"`
+	// Aggregation は同じobjectとreasonのeventをSlackに送る時にまとめる
+	Aggregation aggregation `yaml:"aggregation"`
+	// Digest はeventを定期的にまとめて送る
+	Digest *digest `yaml:"digest"`
+	// Escalations は発生回数がthresholdを超えた時に送るalert
+	Escalations []escalation `yaml:"escalations"`
+	// Flapping はkindごとのflappingの検出
+	Flapping []flapping `yaml:"flapping"`
+	// 別のworkspaceに送る場合のtoken。fileはmountしたSecretを想定していて、更新されたら読み直す
+	SlackToken     string `yaml:"slackToken"`
+	SlackTokenFile string `yaml:"slackTokenFile"`
+	// SlackUpdate は同じeventの2回目以降を最初のmessageの更新(update)かthreadへの返信(thread)にする
+	SlackUpdate string `yaml:"slackUpdate"`
+	// Source はentryを読み込んだfile、index はfileの中での順番。logとmetricsに使う
+	Source string `yaml:"-"`
+	index  int
+	// lines はentryの中のyamlのpathと行番号。validationのerrorに使う
+	lines map[string]int
+}
+
+// multiNamespace はnamespacesかnamespaceSelectorで複数のnamespaceを指定しているかどうか
+func (cf Config) multiNamespace() bool {
+	return len(cf.Namespaces) > 0 || cf.NamespaceSelector != ""
+}
+
+// name はlogに出すentryの名前
+func (cf Config) name() string {
+	return fmt.Sprintf("%s: config[%d]", cf.Source, cf.index)
+}
+
+// errorAt はvalidationのerrorに`file:line`を付ける。lineはerrorの先頭のpathの行で、なければ親のpathの行
+func (cf Config) errorAt(e string) string {
+	if cf.lines == nil {
+		return fmt.Sprintf("%s.%s", cf.name(), e)
+	}
+	path := e
+	if i := strings.Index(e, ": "); i >= 0 {
+		path = e[:i]
+	}
+	line, ok := cf.lines[path]
+	for !ok && path != "" {
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			i = 0
+		}
+		path = path[:i]
+		line, ok = cf.lines[path]
+	}
+	return fmt.Sprintf("%s:%d: config[%d].%s", cf.Source, line, cf.index, e)
 }
 
 type watchEvent struct {
@@ -38,12 +108,65 @@ type fieldSelector struct {
 type extraFilter struct {
 	Type    string   `yaml:"type"`
 	Filters []filter `yaml:"filters"`
+	// Expr はCELの式。keepなら式がtrueのeventだけ、dropなら式がtrueのeventを除く
+	Expr string `yaml:"expr"`
+	// Match はall/any/notを組み合わせた条件
+	Match *filterNode `yaml:"match"`
+}
+
+// filterNode はfilterの条件のtree。all、any、not、expr、leafのfilterのどれか1つを指定する
+type filterNode struct {
+	All    []filterNode `yaml:"all"`
+	Any    []filterNode `yaml:"any"`
+	Not    *filterNode  `yaml:"not"`
+	Expr   string       `yaml:"expr"`
+	filter `yaml:",inline"`
+}
+
+// route はmatchの条件でchannelとlogStreamを変える
+type route struct {
+	Match     filterNode `yaml:"match"`
+	Channel   string     `yaml:"channel"`
+	LogStream string     `yaml:"logStream"`
 }
 
 type filter struct {
-	Key       string `yaml:"key"`
-	Value     string `yaml:"value"`
-	Condition string `yaml:"condition"`
+	Key       string   `yaml:"key"`
+	Value     string   `yaml:"value"`
+	Values    []string `yaml:"values"`
+	Operator  string   `yaml:"operator"`
+	Condition string   `yaml:"condition"`
+}
+
+// outputsに指定できる出力先
+const (
+	outputSlack  = "slack"
+	outputCWLogs = "cwlogs"
+	outputStdout = "stdout"
+)
+
+// useOutput はentryがその出力先を使うかどうか。outputsの指定がなければ全部使う
+func (cf Config) useOutput(o string) bool {
+	if len(cf.Outputs) == 0 {
+		return true
+	}
+	for _, v := range cf.Outputs {
+		if v == o {
+			return true
+		}
+	}
+	return false
+}
+
+// templateFiles はentryで指定されたtemplate file
+func (cf Config) templateFiles() []string {
+	var files []string
+	for _, f := range []string{cf.SlackTemplateFile, cf.CWLogsTemplateFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
 }
 
 //configの指定がない場合のdefaultを設けておく
@@ -64,53 +187,465 @@ func configPath() string {
 	return r.ReplaceAllString(*confPath, home)
 }
 
-// LoadConfig :yamlファイルを読み込む
+// configFiles は-configで指定されたfile。directoryならその中の*.yamlと*.yml、globならmatchしたfile
+func configFiles() ([]string, error) {
+	p := configPath()
+	if o, err := os.Stat(p); err == nil && o.IsDir() {
+		var files []string
+		for _, ptn := range []string{"*.yaml", "*.yml"} {
+			m, err := filepath.Glob(filepath.Join(p, ptn))
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range m {
+				// ConfigMapの`..data`などは読まない
+				if strings.HasPrefix(filepath.Base(f), ".") {
+					continue
+				}
+				files = append(files, f)
+			}
+		}
+		sort.Strings(files)
+		if len(files) == 0 {
+			return nil, fmt.Errorf("config error: no yaml file in %s", p)
+		}
+		return files, nil
+	}
+	if strings.ContainsAny(p, "*?[") {
+		files, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("config error: %s: %s", p, err)
+		}
+		sort.Strings(files)
+		if len(files) == 0 {
+			return nil, fmt.Errorf("config error: no file matches %s", p)
+		}
+		return files, nil
+	}
+	return []string{p}, nil
+}
+
+// LoadConfig :yamlファイルを読み込む。複数のfileなら1つのlistにまとめる
 func LoadConfig() ([]Config, error) {
+	c, warns, err := loadConfig()
+	for _, w := range warns {
+		glog.Warningf("config warning: %s", w)
+	}
+	return c, err
+}
+
+func loadConfig() ([]Config, []string, error) {
 	var c []Config
-	buf, err := ioutil.ReadFile(configPath())
+	var warns []string
+	files, err := configFiles()
 	if err != nil {
-		return c, err
+		return c, warns, err
+	}
+	for _, f := range files {
+		fc, fw, err := loadConfigFile(f)
+		if err != nil {
+			return c, warns, err
+		}
+		c = append(c, fc...)
+		warns = append(warns, fw...)
 	}
 
-	//yamlに対応するfieldがなければ空の値がstructに入る
-	err = yaml.Unmarshal(buf, &c)
+	err = validateConfig(c)
+	if err == nil {
+		warns = append(warns, checkOverlaps(c)...)
+	}
+	eventWatcherConfigEntries.Reset()
+	for _, cf := range c {
+		eventWatcherConfigEntries.WithLabelValues(cf.Source).Inc()
+	}
+
+	glog.Infof("config loaded: %+v\n", redactConfig(c))
+	return c, warns, err
+}
+
+func loadConfigFile(f string) ([]Config, []string, error) {
+	var c []Config
+	buf, err := ioutil.ReadFile(f)
 	if err != nil {
-		return c, err
+		return c, nil, err
 	}
 
-	err = validateConfig(c)
+	//typoに気づけるように知らないfieldはエラーにする
+	err = yaml.UnmarshalStrict(buf, &c)
+	if err != nil {
+		return c, nil, fmt.Errorf("config error: %s: %s", f, err)
+	}
+	lines := configLines(buf)
+	var errs []string
+	for i := range c {
+		c[i].Source = f
+		c[i].index = i
+		if i < len(lines) {
+			c[i].lines = lines[i]
+		}
+		for _, e := range expandEnvFields(reflect.ValueOf(&c[i]).Elem(), "") {
+			errs = append(errs, c[i].errorAt(e))
+		}
+	}
+	// validate commandでは未定義の変数は警告にする
+	if validateOnly {
+		return c, errs, nil
+	}
+	if len(errs) > 0 {
+		return c, nil, fmt.Errorf("config error:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return c, nil, nil
+}
 
-	glog.Infof("config loaded: %+v\n", c)
-	return c, err
+// configLines はentryごとに、yamlのpath(`extraFilter.filters[0].value`)と行番号のmapを作る
+// yaml.v2はdecodeした値の行番号を返さないので、yaml.v3のNodeで読み直す
+func configLines(buf []byte) []map[string]int {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(buf, &doc); err != nil || len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yamlv3.SequenceNode {
+		return nil
+	}
+	lines := make([]map[string]int, len(root.Content))
+	for i, n := range root.Content {
+		lines[i] = map[string]int{}
+		addLines(lines[i], n, "", n.Line)
+	}
+	return lines
+}
+
+func addLines(lines map[string]int, n *yamlv3.Node, path string, line int) {
+	lines[path] = line
+	switch n.Kind {
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			addLines(lines, v, joinPath(path, k.Value), k.Line)
+		}
+	case yamlv3.SequenceNode:
+		for i, v := range n.Content {
+			addLines(lines, v, fmt.Sprintf("%s[%d]", path, i), v.Line)
+		}
+	case yamlv3.AliasNode:
+		if n.Alias != nil {
+			addLines(lines, n.Alias, path, line)
+		}
+	}
+}
+
+// fieldSelectorで指定できるkey
+var supportedFieldSelectors = map[string]bool{
+	"involvedObject.kind":            true,
+	"involvedObject.namespace":       true,
+	"involvedObject.name":            true,
+	"involvedObject.uid":             true,
+	"involvedObject.apiVersion":      true,
+	"involvedObject.resourceVersion": true,
+	"involvedObject.fieldPath":       true,
+	"reason":                         true,
+	"source":                         true,
+	"type":                           true,
+	"metadata.namespace":             true,
+	"metadata.name":                  true,
+}
+
+// redactConfig はlogに出すためにtokenを伏せる
+func redactConfig(conf []Config) []Config {
+	r := make([]Config, len(conf))
+	for i, cf := range conf {
+		if cf.SlackToken != "" {
+			cf.SlackToken = "<redacted>"
+		}
+		r[i] = cf
+	}
+	return r
 }
 
 func validateConfig(conf []Config) error {
-	// 指定なければデフォルト値が入ってとりあえず動くから一旦これで
 	if len(conf) == 0 {
 		return errors.New("config error: set at least one")
 	}
+	var errs []string
+	for _, cf := range conf {
+		for _, e := range validateEntry(cf) {
+			errs = append(errs, cf.errorAt(e))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("config error:\n  %s", strings.Join(errs, "\n  "))
+	}
 	return nil
 }
 
+func validateEntry(cf Config) []string {
+	var errs []string
+	if cf.Namespace != "" && cf.multiNamespace() {
+		errs = append(errs, "namespace: can't be set with namespaces or namespaceSelector")
+	}
+	for i, ns := range cf.Namespaces {
+		if ns == "" {
+			errs = append(errs, fmt.Sprintf("namespaces[%d]: must not be empty", i))
+		}
+	}
+	if cf.NamespaceSelector != "" {
+		if _, err := k8slabels.Parse(cf.NamespaceSelector); err != nil {
+			errs = append(errs, fmt.Sprintf("namespaceSelector: %s", err))
+		}
+	}
+	for i, s := range cf.FieldSelectors {
+		if !supportedFieldSelectors[s.Key] {
+			errs = append(errs, fmt.Sprintf("fieldSelectors[%d].key: unsupported field selector %q", i, s.Key))
+		}
+		switch s.Type {
+		case "", "include", "exclude":
+		default:
+			errs = append(errs, fmt.Sprintf("fieldSelectors[%d].type: must be include or exclude, got %q", i, s.Type))
+		}
+	}
+	switch cf.ExtraFilter.Type {
+	case "", "keep", "drop":
+	default:
+		errs = append(errs, fmt.Sprintf("extraFilter.type: must be keep or drop, got %q", cf.ExtraFilter.Type))
+	}
+	if cf.ExtraFilter.Type == "" && (len(cf.ExtraFilter.Filters) > 0 || cf.ExtraFilter.Expr != "") {
+		errs = append(errs, "extraFilter.type: must be set when filters or expr are set")
+	}
+	if cf.ExtraFilter.Expr != "" {
+		if _, err := compileExpr(cf.ExtraFilter.Expr); err != nil {
+			errs = append(errs, fmt.Sprintf("extraFilter.expr: %s", err))
+		}
+	}
+	for i, o := range cf.Outputs {
+		switch o {
+		case outputSlack, outputCWLogs, outputStdout:
+		default:
+			errs = append(errs, fmt.Sprintf("outputs[%d]: must be slack, cwlogs or stdout, got %q", i, o))
+		}
+	}
+	if cf.SlackToken != "" && cf.SlackTokenFile != "" {
+		errs = append(errs, "slackToken: can't be set with slackTokenFile")
+	}
+	if cf.SlackTokenFile != "" && !validateOnly {
+		if _, err := loadSecretFile(cf.SlackTokenFile).read(); err != nil {
+			errs = append(errs, fmt.Sprintf("slackTokenFile: %s", err))
+		}
+	}
+	if cf.SlackTemplate != "" {
+		if _, err := parseTemplate(cf.SlackTemplate, slackTplFuncs, v1.Event{}); err != nil {
+			errs = append(errs, fmt.Sprintf("slackTemplate: %s", err))
+		}
+	}
+	if cf.SlackTemplateFile != "" {
+		if _, err := parseTemplateFile(cf.SlackTemplateFile, slackTplFuncs, v1.Event{}); err != nil {
+			errs = append(errs, fmt.Sprintf("slackTemplateFile: %s", err))
+		}
+	}
+	if cf.CWLogsTemplate != "" {
+		if _, err := parseTemplate(cf.CWLogsTemplate, tplFuncs, evPlusAct{}); err != nil {
+			errs = append(errs, fmt.Sprintf("cwlogsTemplate: %s", err))
+		}
+	}
+	if cf.CWLogsTemplateFile != "" {
+		if _, err := parseTemplateFile(cf.CWLogsTemplateFile, tplFuncs, evPlusAct{}); err != nil {
+			errs = append(errs, fmt.Sprintf("cwlogsTemplateFile: %s", err))
+		}
+	}
+	if cf.ExtraFilter.Type == "" && cf.ExtraFilter.Match != nil {
+		errs = append(errs, "extraFilter.type: must be set when match is set")
+	}
+	if cf.ExtraFilter.Match != nil {
+		errs = append(errs, validateFilterNode("extraFilter.match", *cf.ExtraFilter.Match)...)
+	}
+	for i, f := range cf.ExtraFilter.Filters {
+		for _, e := range validateFilter(f) {
+			errs = append(errs, fmt.Sprintf("extraFilter.filters[%d].%s", i, e))
+		}
+		switch f.Condition {
+		case "", "and", "or":
+		default:
+			errs = append(errs, fmt.Sprintf("extraFilter.filters[%d].condition: must be and or or, got %q", i, f.Condition))
+		}
+	}
+	for i, r := range cf.Routes {
+		if r.Channel == "" && r.LogStream == "" {
+			errs = append(errs, fmt.Sprintf("routes[%d]: channel or logStream must be set", i))
+		}
+		errs = append(errs, validateFilterNode(fmt.Sprintf("routes[%d].match", i), r.Match)...)
+	}
+	switch cf.SlackUpdate {
+	case "", slackUpdateMessage, slackUpdateThread:
+	default:
+		errs = append(errs, fmt.Sprintf("slackUpdate: must be %s or %s, got %q", slackUpdateMessage, slackUpdateThread, cf.SlackUpdate))
+	}
+	errs = append(errs, validateAggregation(cf.Aggregation)...)
+	if cf.Digest != nil {
+		errs = append(errs, validateDigest(*cf.Digest)...)
+	}
+	for i, f := range cf.Flapping {
+		for _, err := range validateFlapping(f) {
+			errs = append(errs, fmt.Sprintf("flapping[%d].%s", i, err))
+		}
+	}
+	for i, e := range cf.Escalations {
+		for _, err := range validateEscalation(e) {
+			errs = append(errs, fmt.Sprintf("escalations[%d].%s", i, err))
+		}
+	}
+	for i, sc := range cf.Schedules {
+		for _, e := range validateSchedule(sc) {
+			errs = append(errs, fmt.Sprintf("schedules[%d].%s", i, e))
+		}
+	}
+	return errs
+}
+
+// checkOverlaps は重複したentryと、別のfileで同じeventを通知しそうなentryを探す
+func checkOverlaps(conf []Config) []string {
+	var warns []string
+	for i := 0; i < len(conf); i++ {
+		for j := i + 1; j < len(conf); j++ {
+			a, b := conf[i], conf[j]
+			if sameEntry(a, b) {
+				warns = append(warns, fmt.Sprintf("%s and %s are duplicate, events will be notified twice", a.name(), b.name()))
+				continue
+			}
+			if a.Source != b.Source && overlapEntry(a, b) {
+				warns = append(warns, fmt.Sprintf("%s and %s overlap, some events may be notified twice", a.name(), b.name()))
+			}
+		}
+	}
+	return warns
+}
+
+func sameEntry(a Config, b Config) bool {
+	ab, err1 := yaml.Marshal(a)
+	bb, err2 := yaml.Marshal(b)
+	return err1 == nil && err2 == nil && string(ab) == string(bb)
+}
+
+// overlapEntry はnamespace、watchEvent、fieldSelectors、outputsのどれを見ても同じeventを拾いうるかどうか
+func overlapEntry(a Config, b Config) bool {
+	if !overlapNamespaces(a, b) {
+		return false
+	}
+	if !(a.WatchEvent.ADDED && b.WatchEvent.ADDED) && !(a.WatchEvent.MODIFIED && b.WatchEvent.MODIFIED) && !(a.WatchEvent.DELETED && b.WatchEvent.DELETED) {
+		return false
+	}
+	for _, fa := range a.FieldSelectors {
+		for _, fb := range b.FieldSelectors {
+			if fa.Key != fb.Key {
+				continue
+			}
+			if fa.Type == "include" && fb.Type == "include" && fa.Value != fb.Value {
+				return false
+			}
+			if fa.Value == fb.Value && (fa.Type == "include" && fb.Type == "exclude" || fa.Type == "exclude" && fb.Type == "include") {
+				return false
+			}
+		}
+	}
+	for _, o := range []string{outputSlack, outputCWLogs, outputStdout} {
+		if a.useOutput(o) && b.useOutput(o) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapNamespaces はnamespaceが重なりうるかどうか。selectorはどのnamespaceにmatchするかわからないので重なるとみなす
+func overlapNamespaces(a Config, b Config) bool {
+	nsA, nsB := entryNamespaces(a), entryNamespaces(b)
+	if nsA == nil || nsB == nil {
+		return true
+	}
+	for _, x := range nsA {
+		for _, y := range nsB {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// entryNamespaces は明示されたnamespace。全namespaceかselectorの場合はnil
+func entryNamespaces(cf Config) []string {
+	if cf.NamespaceSelector != "" {
+		return nil
+	}
+	if len(cf.Namespaces) > 0 {
+		return cf.Namespaces
+	}
+	if cf.Namespace != "" {
+		return []string{cf.Namespace}
+	}
+	return nil
+}
+
+// ValidateConfig : 設定fileとtemplate fileを読み込んで検証だけする。警告も返す
+// 環境変数とslackTokenFileはCIなどにはないので、未定義の変数は警告にしてfileは読まない
+func ValidateConfig() ([]string, error) {
+	validateOnly = true
+	_, warns, err := loadConfig()
+	if err != nil {
+		return warns, err
+	}
+	return warns, validateTemplates()
+}
+
 func loadTemplate(dt string, fp string, tf map[string]interface{}, td interface{}) *template.Template {
-	var e error
-	var lt *template.Template
-	var o os.FileInfo
 	if fp != "" {
 		glog.Infof("load template file %v", fp)
-		o, e = os.Stat(fp)
+		lt, e := parseTemplateFile(fp, tf, td)
 		if e == nil {
-			lt, e = template.New(o.Name()).Funcs(tf).ParseFiles(fp)
-			if e == nil {
-				e = lt.Execute(ioutil.Discard, td)
-				if e == nil {
-					return lt
-				}
-			}
+			return lt
 		}
-	}
-	if e != nil {
 		glog.Errorf("load default template since load error : %v", e)
 	}
 	return template.Must(template.New("").Funcs(tf).Parse(dt))
 }
+
+// loadEntryTemplate はentryで指定されたtemplateを読み込む。inline、entryのfile、flagのfile、defaultの順に使う
+func loadEntryTemplate(dt string, inline string, fp string, globalFp string, tf map[string]interface{}, td interface{}) *template.Template {
+	if inline != "" {
+		lt, e := parseTemplate(inline, tf, td)
+		if e == nil {
+			return lt
+		}
+		glog.Errorf("ignore inline template since parse error : %v", e)
+	}
+	if fp == "" {
+		fp = globalFp
+	}
+	return loadTemplate(dt, fp, tf, td)
+}
+
+// parseTemplate はinlineのtemplateを読み込んでtdで試しに実行してみる
+func parseTemplate(text string, tf map[string]interface{}, td interface{}) (*template.Template, error) {
+	lt, e := template.New("inline").Funcs(tf).Parse(text)
+	if e != nil {
+		return nil, e
+	}
+	if e := lt.Execute(ioutil.Discard, td); e != nil {
+		return nil, e
+	}
+	return lt, nil
+}
+
+// parseTemplateFile はtemplateを読み込んでtdで試しに実行してみる
+func parseTemplateFile(fp string, tf map[string]interface{}, td interface{}) (*template.Template, error) {
+	o, e := os.Stat(fp)
+	if e != nil {
+		return nil, e
+	}
+	lt, e := template.New(o.Name()).Funcs(tf).ParseFiles(fp)
+	if e != nil {
+		return nil, e
+	}
+	if e := lt.Execute(ioutil.Discard, td); e != nil {
+		return nil, e
+	}
+	return lt, nil
+}
@@ -0,0 +1,50 @@
+package watcher
+
+import (
+	"time"
+)
+
+// eventCountsTTL の間updateがないeventのcountは忘れる。Eventはdefaultで1時間で消える
+const eventCountsTTL = time.Hour
+
+// eventCounts はevent名ごとに最後に見たcount。MODIFIEDで増えた分だけを発生回数にする
+// lockは持たないので、使う側のlockの中で呼ぶ
+type eventCounts struct {
+	last      map[string]eventCount
+	lastPrune time.Time
+}
+
+type eventCount struct {
+	count int32
+	seen  time.Time
+}
+
+func newEventCounts() *eventCounts {
+	return &eventCounts{last: map[string]eventCount{}}
+}
+
+// delta は前に見た時から増えた発生回数。初めて見たeventはそれまでのcountを基準にして1回と数える
+// countが増えていないupdate（relistやresync、同じcountのMODIFIED）は0回
+func (c *eventCounts) delta(key string, count int32, now time.Time) int {
+	n := 1
+	if l, ok := c.last[key]; ok {
+		n = 0
+		if count > l.count {
+			n = int(count - l.count)
+		}
+	}
+	c.last[key] = eventCount{count: count, seen: now}
+	if now.Sub(c.lastPrune) > eventCountsTTL/10 {
+		c.prune(now)
+	}
+	return n
+}
+
+func (c *eventCounts) prune(now time.Time) {
+	c.lastPrune = now
+	for k, l := range c.last {
+		if now.Sub(l.seen) > eventCountsTTL {
+			delete(c.last, k)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package watcher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventCountsDelta(t *testing.T) {
+	c := newEventCounts()
+	now := time.Now()
+	steps := []struct {
+		key   string
+		count int32
+		want  int
+	}{
+		{"default/a", 5, 1},
+		{"default/a", 5, 0},
+		{"default/a", 6, 1},
+		{"default/a", 9, 3},
+		{"default/a", 7, 0},
+		{"default/a", 8, 1},
+		{"default/b", 1, 1},
+		{"default/b", 1, 0},
+	}
+	for i, s := range steps {
+		if got := c.delta(s.key, s.count, now); got != s.want {
+			t.Errorf("step %d %s count %d: got %d, want %d", i, s.key, s.count, got, s.want)
+		}
+	}
+	// TTLより前に見たeventは忘れて、また1回と数える
+	c.prune(now.Add(eventCountsTTL + time.Second))
+	if got := c.delta("default/a", 20, now.Add(eventCountsTTL+time.Second)); got != 1 {
+		t.Errorf("after prune: got %d, want 1", got)
+	}
+}
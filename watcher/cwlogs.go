@@ -23,6 +23,14 @@ type cwLogConfig struct {
 	Template    *template.Template
 }
 
+// cwLogsPost はoutboxに保存するCloudwatch logsのevent
+type cwLogsPost struct {
+	Group     string `json:"group"`
+	Stream    string `json:"stream"`
+	Message   string `json:"message"`
+	Timestamp int64  `json:"timestamp"`
+}
+
 type evPlusAct struct {
 	v1.Event
 	Action string
@@ -64,17 +72,21 @@ var tplFuncs = map[string]interface{}{
 	},
 }
 
-func loadCWLogConfig() cwLogConfig {
+func loadCWLogConfig(cf Config) cwLogConfig {
 	te := evPlusAct{
 		Event:  v1.Event{},
 		Action: "",
 	}
-	return cwLogConfig{
-		CWLogging:   *globalCWLogging,
+	c := cwLogConfig{
+		CWLogging:   *globalCWLogging && cf.useOutput(outputCWLogs),
 		CWLogGroup:  *globalCWLogGroup,
 		CWLogStream: *globalCWLogStream,
-		Template:    loadTemplate(cwlogDefTpl, *cwlogsTemplateFile, tplFuncs, te),
+		Template:    loadEntryTemplate(cwlogDefTpl, cf.CWLogsTemplate, cf.CWLogsTemplateFile, *cwlogsTemplateFile, tplFuncs, te),
 	}
+	if cf.LogStream != "" {
+		c.CWLogStream = cf.LogStream
+	}
+	return c
 }
 
 // ValidateCWLogs : 指定されたCWLogsのlogGroupとlogStreamが使用可能かどうか
@@ -203,7 +215,7 @@ func prepareCWMessage(event v1.Event, action string, tpl *template.Template) (st
 }
 
 func postEventToCWLogs(obj interface{}, action string, conf cwLogConfig) error {
-	if !*globalCWLogging {
+	if !conf.CWLogging {
 		return nil
 	}
 	cwevent := []*cloudwatchlogs.InputLogEvent{}
@@ -220,7 +232,32 @@ func postEventToCWLogs(obj interface{}, action string, conf cwLogConfig) error {
 		glog.Errorf("Not supported type : %T\n", obj)
 		return nil
 	}
+	if deliveryOutbox != nil {
+		return deliveryOutbox.enqueue(outboxItem{Output: outputCWLogs, CWLogs: &cwLogsPost{
+			Group:     conf.CWLogGroup,
+			Stream:    conf.CWLogStream,
+			Message:   aws.StringValue(e.Message),
+			Timestamp: aws.Int64Value(e.Timestamp),
+		}})
+	}
 	cwevent = append(cwevent, e)
+	// rate limitで送れなかったものは数だけ後で送る
+	dest := conf.CWLogGroup + "/" + conf.CWLogStream
+	l := limiterFor(outputCWLogs, dest, *cwlogsRateLimit, *cwlogsRateBurst)
+	if !l.allow(func(n int) { putCWLogsSummary(n, conf) }) {
+		return nil
+	}
 	err := tokenAndPutWithRetry(cwevent, conf.CWLogGroup, conf.CWLogStream)
 	return err
 }
+
+// putCWLogsSummary はrate limitで送れなかった数を送る
+func putCWLogsSummary(n int, conf cwLogConfig) {
+	e := &cloudwatchlogs.InputLogEvent{
+		Message:   aws.String(rateLimitMessage(n, outputCWLogs, conf.CWLogGroup+"/"+conf.CWLogStream)),
+		Timestamp: aws.Int64(time.Now().Unix() * 1000),
+	}
+	if err := tokenAndPutWithRetry([]*cloudwatchlogs.InputLogEvent{e}, conf.CWLogGroup, conf.CWLogStream); err != nil {
+		glog.Errorf("Error put rate limit summary to cloudwatch logs : %s\n", err)
+	}
+}
@@ -0,0 +1,223 @@
+package watcher
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultSlackMaxRetries    = 5
+	defaultSlackRetryBackoff  = time.Second
+	defaultCWLogsMaxRetries   = 5
+	defaultCWLogsRetryBackoff = time.Second
+	// maxDeliveryBackoff は送り直すまでの時間の上限
+	maxDeliveryBackoff = 5 * time.Minute
+)
+
+var (
+	slackMaxRetries    = flag.Int("slackMaxRetries", defaultSlackMaxRetries, "How many times to retry a failed message to Slack. Other outputs of the event are not retried.")
+	slackRetryBackoff  = flag.Duration("slackRetryBackoff", defaultSlackRetryBackoff, "Interval of the first retry to Slack. It's doubled on each retry.")
+	cwlogsMaxRetries   = flag.Int("cwlogsMaxRetries", defaultCWLogsMaxRetries, "How many times to retry a failed put to Cloudwatch logs. Other outputs of the event are not retried.")
+	cwlogsRetryBackoff = flag.Duration("cwlogsRetryBackoff", defaultCWLogsRetryBackoff, "Interval of the first retry to Cloudwatch logs. It's doubled on each retry.")
+)
+
+// retryPolicy は出力先ごとの送り直し方
+type retryPolicy struct {
+	maxRetries int
+	backoff    time.Duration
+}
+
+func retryPolicyFor(output string) retryPolicy {
+	switch output {
+	case outputSlack:
+		return retryPolicy{maxRetries: *slackMaxRetries, backoff: *slackRetryBackoff}
+	case outputCWLogs:
+		return retryPolicy{maxRetries: *cwlogsMaxRetries, backoff: *cwlogsRetryBackoff}
+	}
+	return retryPolicy{}
+}
+
+// delay はattempts回失敗した後に待つ時間
+func (p retryPolicy) delay(attempts int) time.Duration {
+	d := p.backoff
+	for i := 1; i < attempts && d < maxDeliveryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxDeliveryBackoff {
+		d = maxDeliveryBackoff
+	}
+	return d
+}
+
+// pendingDelivery はeventの出力先ごとの送信状態。送れた出力先は消して、失敗した出力先だけ送り直す
+// sendsのkeyは出力先で、前のupdateから引き継いだものは`<出力先>@<resourceVersion>`
+type pendingDelivery struct {
+	ev event
+	// resourceVersion が変わったら新しいupdateとして最初から処理する
+	resourceVersion string
+	event           *v1.Event
+	sends           map[string]*sinkDelivery
+}
+
+type sinkDelivery struct {
+	output string
+	send   func() error
+	// overwrite は新しいupdateの送信で上書きされる送信（slackUpdate: updateのSlack）。新しいupdateが来たら送らない
+	overwrite bool
+	attempts  int
+	next      time.Time
+}
+
+func newPendingDelivery(ev event, event *v1.Event) *pendingDelivery {
+	p := &pendingDelivery{ev: ev, event: event, sends: map[string]*sinkDelivery{}}
+	if event != nil {
+		p.resourceVersion = event.ResourceVersion
+	}
+	return p
+}
+
+func (p *pendingDelivery) add(output string, overwrite bool, send func() error) {
+	p.sends[output] = &sinkDelivery{output: output, send: send, overwrite: overwrite}
+}
+
+// retryItem はqueueに入れる送り直しの要求。eventとは別のitemなので、送り直しでfilterやstdoutは繰り返さない
+type retryItem struct {
+	ev              event
+	resourceVersion string
+}
+
+// deliveryError は送れなかった出力先がある時のerror。handleErrがretryAfterの後にretryItemをqueueに入れる
+type deliveryError struct {
+	item       retryItem
+	retryAfter time.Duration
+	errs       []string
+}
+
+func (e *deliveryError) Error() string {
+	return strings.Join(e.errs, ", ")
+}
+
+// deliver はまだ送っていない出力先に送る。失敗した出力先が残っていればdeliveryErrorを返す
+func (c *controller) deliver(p *pendingDelivery) error {
+	ev := p.ev
+	now := time.Now()
+	var outputs []string
+	for o := range p.sends {
+		outputs = append(outputs, o)
+	}
+	sort.Strings(outputs)
+	de := &deliveryError{item: retryItem{ev: ev, resourceVersion: p.resourceVersion}, retryAfter: maxDeliveryBackoff}
+	for _, k := range outputs {
+		s := p.sends[k]
+		o := s.output
+		if s.next.After(now) {
+			if d := s.next.Sub(now); d < de.retryAfter {
+				de.retryAfter = d
+			}
+			continue
+		}
+		err := s.send()
+		if err == nil {
+			delete(p.sends, k)
+			continue
+		}
+		s.attempts++
+		policy := retryPolicyFor(o)
+		if s.attempts > policy.maxRetries {
+			glog.Errorf("Dropping %s of Event %q after %d attempts: %v", o, ev.key, s.attempts, err)
+			eventWatcherDeliveryDropped.WithLabelValues(o, c.source).Inc()
+			delete(p.sends, k)
+			continue
+		}
+		d := policy.delay(s.attempts)
+		s.next = now.Add(d)
+		if d < de.retryAfter {
+			de.retryAfter = d
+		}
+		de.errs = append(de.errs, fmt.Sprintf("%s: %s", o, err))
+	}
+
+	c.deliveriesMu.Lock()
+	defer c.deliveriesMu.Unlock()
+	if len(p.sends) == 0 {
+		if c.deliveries[ev.key] == p {
+			delete(c.deliveries, ev.key)
+		}
+		return nil
+	}
+	c.deliveries[ev.key] = p
+	if len(de.errs) == 0 {
+		de.errs = append(de.errs, "waiting for retry")
+	}
+	return de
+}
+
+// deliverLater はeventの処理の外で作る通知（aggregationのまとめ）をeventと同じように出力先ごとに送り直す
+// workerの外から呼ぶので、失敗したらhandleErrの代わりにretryItemをqueueに入れる
+func (c *controller) deliverLater(key string, output string, overwrite bool, send func() error) {
+	p := newPendingDelivery(event{key: key}, nil)
+	p.add(output, overwrite, send)
+	c.replaceDelivery(p)
+	err := c.deliver(p)
+	de, ok := err.(*deliveryError)
+	if !ok {
+		return
+	}
+	if c.queue.ShuttingDown() {
+		glog.Errorf("Dropping %s of %q on stop: %v", output, key, err)
+		eventWatcherDeliveryDropped.WithLabelValues(output, c.source).Inc()
+		c.deliveriesMu.Lock()
+		delete(c.deliveries, key)
+		c.deliveriesMu.Unlock()
+		return
+	}
+	glog.Errorf("Error delivering %q, retry in %s: %v", key, de.retryAfter, err)
+	c.queue.AddAfter(de.item, de.retryAfter)
+}
+
+// retry は失敗した出力先に送り直す。その後に新しいupdateが来ていれば何もしない
+func (c *controller) retry(item retryItem) error {
+	c.deliveriesMu.Lock()
+	p, ok := c.deliveries[item.ev.key]
+	c.deliveriesMu.Unlock()
+	if !ok || p.ev != item.ev || p.resourceVersion != item.resourceVersion {
+		return nil
+	}
+	if err := c.deliver(p); err != nil {
+		return err
+	}
+	if deliveryCheckpoint != nil && p.event != nil {
+		deliveryCheckpoint.done(c.entry, p.event)
+	}
+	return nil
+}
+
+// replaceDelivery は同じeventの新しいupdateやdeleteで、前のupdateの送れていない出力先をpに引き継ぐ
+// 新しいupdateで上書きされる出力先だけは諦める。cwlogsやSlackの新しいmessageはupdateごとの記録なので送り続ける
+func (c *controller) replaceDelivery(p *pendingDelivery) {
+	c.deliveriesMu.Lock()
+	defer c.deliveriesMu.Unlock()
+	old, ok := c.deliveries[p.ev.key]
+	if !ok {
+		return
+	}
+	delete(c.deliveries, p.ev.key)
+	for k, s := range old.sends {
+		if s.overwrite {
+			if glog.V(1) {
+				glog.Infof("Skip %s of Event %q, overwritten by a newer update", s.output, p.ev.key)
+			}
+			continue
+		}
+		if k == s.output {
+			k = s.output + "@" + old.resourceVersion
+		}
+		p.sends[k] = s
+	}
+}
@@ -0,0 +1,86 @@
+package watcher
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestReplaceDeliveryKeepsRecords(t *testing.T) {
+	c := &controller{source: "test", deliveries: map[string]*pendingDelivery{}}
+	ev := event{key: "default/a"}
+	calls := map[string]int{}
+	send := func(name string, err error) func() error {
+		return func() error {
+			calls[name]++
+			return err
+		}
+	}
+	failed := errors.New("failed")
+
+	p1 := newPendingDelivery(ev, &v1.Event{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"}})
+	p1.add(outputSlack, true, send("slack1", failed))
+	p1.add(outputCWLogs, false, send("cwlogs1", failed))
+	if err := c.deliver(p1); err == nil {
+		t.Fatal("expected delivery error")
+	}
+	// 前のupdateのcwlogsは引き継いで送り直し、上書きされるSlackは送らない
+	for _, s := range p1.sends {
+		s.send = send(s.output+"1", nil)
+	}
+	p2 := newPendingDelivery(ev, &v1.Event{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "2"}})
+	p2.add(outputSlack, true, send("slack2", nil))
+	p2.add(outputCWLogs, false, send("cwlogs2", nil))
+	c.replaceDelivery(p2)
+	for _, s := range p2.sends {
+		s.next = s.next.AddDate(-1, 0, 0)
+	}
+	if err := c.deliver(p2); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	want := map[string]int{"slack1": 1, "cwlogs1": 2, "slack2": 1, "cwlogs2": 1}
+	for k, n := range want {
+		if calls[k] != n {
+			t.Errorf("%s: got %d calls, want %d", k, calls[k], n)
+		}
+	}
+	if _, ok := c.deliveries[ev.key]; ok {
+		t.Error("delivery is left after all outputs are sent")
+	}
+}
+
+func TestDeliverLaterRetries(t *testing.T) {
+	defer func(d time.Duration) { *slackRetryBackoff = d }(*slackRetryBackoff)
+	*slackRetryBackoff = 10 * time.Millisecond
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	c := &controller{source: "test", queue: queue, deliveries: map[string]*pendingDelivery{}}
+	calls := 0
+	send := func() error {
+		calls++
+		if calls == 1 {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	c.deliverLater("aggregate/a", outputSlack, false, send)
+	item, _ := queue.Get()
+	ri, ok := item.(retryItem)
+	if !ok || ri.ev.key != "aggregate/a" {
+		t.Fatalf("queued %#v, want retryItem of aggregate/a", item)
+	}
+	if err := c.retry(ri); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	queue.Done(item)
+	if calls != 2 {
+		t.Errorf("got %d calls, want 2", calls)
+	}
+	if _, ok := c.deliveries["aggregate/a"]; ok {
+		t.Error("delivery is left after it's sent")
+	}
+}
@@ -0,0 +1,302 @@
+package watcher
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+)
+
+// digestのinterval
+const (
+	digestHourly = "hourly"
+	digestDaily  = "daily"
+	// digestTop はreasonとobjectを多い順にいくつ出すか
+	digestTop = 5
+)
+
+// digest はeventを貯めて、定期的にまとめてSlackやemailに送る設定
+// keepRealtimeでなければ、entryのeventはその都度は通知しない
+type digest struct {
+	Interval     string   `yaml:"interval"`
+	At           string   `yaml:"at"`
+	Timezone     string   `yaml:"timezone"`
+	Channel      string   `yaml:"channel"`
+	Email        []string `yaml:"email"`
+	KeepRealtime bool     `yaml:"keepRealtime"`
+}
+
+func validateDigest(d digest) []string {
+	var errs []string
+	switch d.Interval {
+	case digestHourly:
+		if d.At != "" {
+			errs = append(errs, "digest.at: can't be set with hourly")
+		}
+	case digestDaily:
+		if d.At != "" {
+			if _, err := parseClock(d.At); err != nil {
+				errs = append(errs, fmt.Sprintf("digest.at: %s", err))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("digest.interval: must be %s or %s, got %q", digestHourly, digestDaily, d.Interval))
+	}
+	if d.Timezone != "" {
+		if _, err := time.LoadLocation(d.Timezone); err != nil {
+			errs = append(errs, fmt.Sprintf("digest.timezone: %s", err))
+		}
+	}
+	for i, a := range d.Email {
+		if _, err := mail.ParseAddress(a); err != nil {
+			errs = append(errs, fmt.Sprintf("digest.email[%d]: %s", i, err))
+		}
+	}
+	return errs
+}
+
+func (d digest) location() *time.Location {
+	if d.Timezone != "" {
+		if l, err := time.LoadLocation(d.Timezone); err == nil {
+			return l
+		}
+	}
+	return time.Local
+}
+
+// next はnowの次にdigestを送る時刻。hourlyは毎時0分、dailyはat（指定がなければ0:00）
+func (d digest) next(now time.Time) time.Time {
+	loc := d.location()
+	t := now.In(loc)
+	if d.Interval == digestHourly {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+	}
+	at, _ := parseClock(d.At)
+	n := time.Date(t.Year(), t.Month(), t.Day(), at/60, at%60, 0, 0, loc)
+	if !n.After(t) {
+		n = n.AddDate(0, 0, 1)
+	}
+	return n
+}
+
+// digestReport は1つのdigestの集計。同じ設定のentryは1つのdigestにまとめ、reloadしても集計を引き継ぐ
+type digestReport struct {
+	conf  digest
+	slack slackConfig
+	mu    sync.Mutex
+	since time.Time
+	total int
+	// warnings はnamespaceごとのWarningの数
+	warnings map[string]int
+	reasons  map[string]int
+	objects  map[string]int
+	// counts はevent名ごとの最後のcount。digestを送っても消さない
+	counts *eventCounts
+	// seen はこれまでのdigestに出たreason。最初のdigestは比較するものがないので新しいreasonは出さない
+	seen     map[string]bool
+	baseline bool
+	// key はdigestsのkey。refsはこのdigestを使っているcontrollerの数
+	key      string
+	refs     int
+	timer    *time.Timer
+	released bool
+}
+
+var (
+	digestsMu sync.Mutex
+	digests   = map[string]*digestReport{}
+)
+
+// digestFor は設定に対応するdigestを返す。なければ作ってscheduleする
+func digestFor(cf Config, sc slackConfig) *digestReport {
+	if cf.Digest == nil {
+		return nil
+	}
+	d := *cf.Digest
+	if d.Channel != "" {
+		sc.Channel = d.Channel
+	}
+	key := fmt.Sprintf("%+v/%s/%t", d, sc.Channel, sc.NotifySlack)
+	digestsMu.Lock()
+	defer digestsMu.Unlock()
+	if r, ok := digests[key]; ok {
+		r.mu.Lock()
+		r.slack = sc
+		r.mu.Unlock()
+		r.refs++
+		return r
+	}
+	r := &digestReport{
+		conf:   d,
+		slack:  sc,
+		seen:   map[string]bool{},
+		counts: newEventCounts(),
+		key:    key,
+		refs:   1,
+	}
+	r.reset(time.Now())
+	digests[key] = r
+	r.schedule()
+	return r
+}
+
+// release はcontrollerが止まった時に呼ぶ。どのcontrollerも使わなくなったらdigestを止めて消す
+func (r *digestReport) release() {
+	if r == nil {
+		return
+	}
+	digestsMu.Lock()
+	defer digestsMu.Unlock()
+	r.refs--
+	if r.refs > 0 {
+		return
+	}
+	delete(digests, r.key)
+	r.mu.Lock()
+	r.released = true
+	r.timer.Stop()
+	r.mu.Unlock()
+}
+
+func (r *digestReport) reset(now time.Time) {
+	r.since = now
+	r.total = 0
+	r.warnings = map[string]int{}
+	r.reasons = map[string]int{}
+	r.objects = map[string]int{}
+}
+
+func (r *digestReport) schedule() {
+	next := r.conf.next(time.Now())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.released {
+		return
+	}
+	r.timer = time.AfterFunc(time.Until(next), func() {
+		r.send()
+		r.schedule()
+	})
+}
+
+// add はeventを集計する
+func (r *digestReport) add(e *v1.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.counts.delta(e.Namespace+"/"+e.Name, e.Count, time.Now())
+	if n == 0 {
+		return
+	}
+	r.total += n
+	r.reasons[e.Reason] += n
+	o := e.InvolvedObject
+	r.objects[fmt.Sprintf("%s %s/%s", o.Kind, o.Namespace, o.Name)] += n
+	if e.Type == v1.EventTypeWarning {
+		r.warnings[e.Namespace] += n
+	}
+}
+
+// send は集計をSlackとemailに送って次の集計を始める。eventがなければ送らない
+func (r *digestReport) send() {
+	r.mu.Lock()
+	now := time.Now()
+	if r.total == 0 {
+		r.since = now
+		r.mu.Unlock()
+		return
+	}
+	text := r.textLocked(now)
+	subject := fmt.Sprintf("kube-event-watcher %s digest: %d events", r.conf.Interval, r.total)
+	status := v1.EventTypeNormal
+	if len(r.warnings) > 0 {
+		status = v1.EventTypeWarning
+	}
+	for reason := range r.reasons {
+		r.seen[reason] = true
+	}
+	r.baseline = true
+	sc := r.slack
+	r.reset(now)
+	r.mu.Unlock()
+
+	if err := sendToSlack("", text, "digest", status, sc); err != nil {
+		glog.Errorf("Error post digest to slack : %s\n", err)
+	}
+	if len(r.conf.Email) > 0 {
+		if err := sendEmail(r.conf.Email, subject, text); err != nil {
+			glog.Errorf("Error send digest email : %s\n", err)
+		}
+	}
+}
+
+func (r *digestReport) textLocked(now time.Time) string {
+	var buf bytes.Buffer
+	loc := r.conf.location()
+	fmt.Fprintf(&buf, "%s - %s\n", r.since.In(loc).Format("2006-01-02 15:04"), now.In(loc).Format("2006-01-02 15:04 MST"))
+	warnings := 0
+	for _, n := range r.warnings {
+		warnings += n
+	}
+	fmt.Fprintf(&buf, "events: %d (Warning: %d)\n", r.total, warnings)
+	writeCounts(&buf, "top reasons", topCounts(r.reasons, digestTop))
+	writeCounts(&buf, "top objects", topCounts(r.objects, digestTop))
+	writeCounts(&buf, "Warning per namespace", topCounts(r.warnings, len(r.warnings)))
+	if r.baseline {
+		var reasons []string
+		for reason := range r.reasons {
+			if !r.seen[reason] {
+				reasons = append(reasons, reason)
+			}
+		}
+		if len(reasons) > 0 {
+			sort.Strings(reasons)
+			fmt.Fprintf(&buf, "new reasons:\n")
+			for _, reason := range reasons {
+				fmt.Fprintf(&buf, "  %s (%d)\n", reason, r.reasons[reason])
+			}
+		}
+	}
+	return buf.String()
+}
+
+type namedCount struct {
+	name  string
+	count int
+}
+
+// topCounts は多い順にn個。同じ数なら名前順
+func topCounts(m map[string]int, n int) []namedCount {
+	var list []namedCount
+	for k, v := range m {
+		list = append(list, namedCount{k, v})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].count != list[j].count {
+			return list[i].count > list[j].count
+		}
+		return list[i].name < list[j].name
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+func writeCounts(buf *bytes.Buffer, title string, list []namedCount) {
+	if len(list) == 0 {
+		return
+	}
+	fmt.Fprintf(buf, "%s:\n", title)
+	for _, c := range list {
+		name := c.name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(buf, "  %s (%d)\n", name, c.count)
+	}
+}
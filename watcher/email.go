@@ -0,0 +1,43 @@
+package watcher
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	smtpAddr     = flag.String("smtpAddr", "", "Address of SMTP server to send email, e.g. smtp.example.com:587.")
+	smtpFrom     = flag.String("smtpFrom", "", "From address of email.")
+	smtpUsername = flag.String("smtpUsername", "", "Username of SMTP server. The password is SMTP_PASSWORD.")
+)
+
+// sendEmail はSMTPでtext/plainのmailを送る。SMTP_PASSWORDがあればPLAIN認証する
+func sendEmail(to []string, subject string, body string) error {
+	if *smtpAddr == "" || *smtpFrom == "" {
+		return errors.New("email error: smtpAddr or smtpFrom is empty")
+	}
+	var auth smtp.Auth
+	if *smtpUsername != "" {
+		host, _, err := net.SplitHostPort(*smtpAddr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", *smtpUsername, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", *smtpFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(*smtpAddr, auth, *smtpFrom, to, msg.Bytes())
+}
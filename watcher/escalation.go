@@ -0,0 +1,216 @@
+package watcher
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+	v1 "k8s.io/api/core/v1"
+)
+
+// escalation はwindowの間にmatchするeventがthresholdより多く発生したら、1回だけ別の通知先にalertを送るrule
+// groupByのkeyの値ごとに数える。e.g. groupBy: [ObjectMeta.Namespace, Reason]
+type escalation struct {
+	Name      string      `yaml:"name"`
+	Match     *filterNode `yaml:"match"`
+	GroupBy   []string    `yaml:"groupBy"`
+	Threshold int         `yaml:"threshold"`
+	Window    string      `yaml:"window"`
+	Channel   string      `yaml:"channel"`
+	LogStream string      `yaml:"logStream"`
+	Outputs   []string    `yaml:"outputs"`
+}
+
+func validateEscalation(e escalation) []string {
+	var errs []string
+	if e.Name == "" {
+		errs = append(errs, "name: must be set")
+	}
+	if e.Match != nil {
+		errs = append(errs, validateFilterNode("match", *e.Match)...)
+	}
+	for i, k := range e.GroupBy {
+		if err := validateFilterKey(k); err != nil {
+			errs = append(errs, fmt.Sprintf("groupBy[%d]: %s", i, err))
+		}
+	}
+	if e.Threshold < 1 {
+		errs = append(errs, fmt.Sprintf("threshold: must be positive, got %d", e.Threshold))
+	}
+	if d, err := time.ParseDuration(e.Window); err != nil {
+		errs = append(errs, fmt.Sprintf("window: %s", err))
+	} else if d <= 0 {
+		errs = append(errs, fmt.Sprintf("window: must be positive, got %q", e.Window))
+	}
+	for _, o := range e.Outputs {
+		switch o {
+		case outputSlack, outputCWLogs:
+		default:
+			errs = append(errs, fmt.Sprintf("outputs: must be %s or %s, got %q", outputSlack, outputCWLogs, o))
+		}
+	}
+	return errs
+}
+
+// escalationCounter はescalationのgroupごとのsliding windowの数
+type escalationCounter struct {
+	rule   escalation
+	window time.Duration
+	slack  slackConfig
+	cwlogs cwLogConfig
+	mu     sync.Mutex
+	groups map[string]*escalationGroup
+	// counts はevent名ごとの最後のcount。groupとは別に、一定時間updateがなければ消す
+	counts *eventCounts
+	// key はescalationsのkey。refsはこのcounterを使っているcontrollerの数
+	key  string
+	refs int
+}
+
+type escalationGroup struct {
+	hits []escalationHit
+	// alerted はalertを送った時刻。windowが過ぎるまで同じgroupのalertは送らない
+	alerted time.Time
+}
+
+type escalationHit struct {
+	at time.Time
+	n  int
+}
+
+var (
+	escalationsMu sync.Mutex
+	escalations   = map[string]*escalationCounter{}
+)
+
+// escalationsFor はentryのescalationのcounter。同じruleはnamespaceごとのcontrollerとreloadで共有する
+func escalationsFor(cf Config) []*escalationCounter {
+	var counters []*escalationCounter
+	for _, e := range cf.Escalations {
+		c := cf
+		c.Channel, c.LogStream, c.Outputs = e.Channel, e.LogStream, e.Outputs
+		sc := loadSlackConfig(c)
+		lc := loadCWLogConfig(c)
+		b, _ := yaml.Marshal(e)
+		key := fmt.Sprintf("%s/%s/%s/%t/%t", b, sc.Channel, lc.CWLogStream, sc.NotifySlack, lc.CWLogging)
+		escalationsMu.Lock()
+		ec, ok := escalations[key]
+		if !ok {
+			window, _ := time.ParseDuration(e.Window)
+			ec = &escalationCounter{
+				rule:   e,
+				window: window,
+				groups: map[string]*escalationGroup{},
+				counts: newEventCounts(),
+				key:    key,
+			}
+			escalations[key] = ec
+		}
+		ec.refs++
+		ec.mu.Lock()
+		ec.slack, ec.cwlogs = sc, lc
+		ec.mu.Unlock()
+		escalationsMu.Unlock()
+		counters = append(counters, ec)
+	}
+	return counters
+}
+
+// releaseEscalations はcontrollerが止まった時に呼ぶ。どのcontrollerも使わなくなったcounterは消す
+func releaseEscalations(counters []*escalationCounter) {
+	escalationsMu.Lock()
+	defer escalationsMu.Unlock()
+	for _, ec := range counters {
+		ec.refs--
+		if ec.refs <= 0 {
+			delete(escalations, ec.key)
+		}
+	}
+}
+
+// groupKey はgroupByのkeyの値
+func (c *escalationCounter) groupKey(e *v1.Event) string {
+	var parts []string
+	for _, k := range c.rule.GroupBy {
+		v, ok := resolveField(e, k)
+		s := ""
+		if ok {
+			s = strings.Join(stringsOf(v), ",")
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s", k, s))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// add はeventを数えて、thresholdを超えたらalertを送る
+func (c *escalationCounter) add(e *v1.Event) {
+	if c.rule.Match != nil && !c.rule.Match.eval(e) {
+		return
+	}
+	now := time.Now()
+	key := c.groupKey(e)
+	c.mu.Lock()
+	n := c.counts.delta(e.Namespace+"/"+e.Name, e.Count, now)
+	if n == 0 {
+		c.mu.Unlock()
+		return
+	}
+	g, ok := c.groups[key]
+	if !ok {
+		g = &escalationGroup{}
+		c.groups[key] = g
+	}
+	g.hits = append(g.hits, escalationHit{at: now, n: n})
+	total := c.pruneLocked(now)
+	count := 0
+	for _, h := range g.hits {
+		count += h.n
+	}
+	alert := count > c.rule.Threshold && now.Sub(g.alerted) >= c.window
+	if alert {
+		g.alerted = now
+	}
+	sc, lc := c.slack, c.cwlogs
+	c.mu.Unlock()
+
+	if glog.V(2) {
+		glog.Infof("escalation %s : %d in %s (%s), %d in all groups", c.rule.Name, count, c.window, key, total)
+	}
+	if !alert {
+		return
+	}
+	msg := fmt.Sprintf("escalation %s : %d events in %s (threshold %d)\ngroup: %s\nlast event: %s %s/%s %s %s",
+		c.rule.Name, count, humanDuration(c.window), c.rule.Threshold, key,
+		e.InvolvedObject.Kind, e.InvolvedObject.Namespace, e.InvolvedObject.Name, e.Reason, e.Message)
+	glog.Infof("escalation %s fired (%s)", c.rule.Name, key)
+	eventWatcherEscalations.WithLabelValues(c.rule.Name).Inc()
+	if err := sendToSlack("", msg, "escalation", "Danger", sc); err != nil {
+		glog.Errorf("Error post escalation to slack : %s\n", err)
+	}
+	if err := postEventToCWLogs(msg, "escalation", lc); err != nil {
+		glog.Errorf("Error send escalation to cloudwatch logs : %s\n", err)
+	}
+}
+
+// pruneLocked はwindowより古い発生とalertもhitもないgroupを消す。残った発生の数を返す
+func (c *escalationCounter) pruneLocked(now time.Time) int {
+	total := 0
+	for key, g := range c.groups {
+		i := 0
+		for i < len(g.hits) && now.Sub(g.hits[i].at) > c.window {
+			i++
+		}
+		g.hits = g.hits[i:]
+		if len(g.hits) == 0 && now.Sub(g.alerted) >= c.window {
+			delete(c.groups, key)
+			continue
+		}
+		for _, h := range g.hits {
+			total += h.n
+		}
+	}
+	return total
+}
@@ -0,0 +1,243 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// extraFilterのexprはCELの式で、eventは`event`という変数でjsonと同じfield名で参照する
+// e.g. event.type == "Warning" && event.count > 3
+var (
+	celEnvOnce sync.Once
+	celEnv     *cel.Env
+	celEnvErr  error
+
+	celProgramsMu sync.Mutex
+	celPrograms   = map[string]cel.Program{}
+)
+
+func exprEnv() (*cel.Env, error) {
+	celEnvOnce.Do(func() {
+		provider, err := newEventTypeProvider()
+		if err != nil {
+			celEnvErr = err
+			return
+		}
+		celEnv, celEnvErr = cel.NewEnv(
+			cel.CustomTypeProvider(provider),
+			cel.Variable("event", cel.ObjectType(provider.eventType)),
+			cel.CrossTypeNumericComparisons(true),
+		)
+	})
+	return celEnv, celEnvErr
+}
+
+// eventTypeProvider はv1.Eventのjsonの形をCELのobject typeにする。存在しないfieldや型の違いをcompileの時にerrorにする
+// 評価の時のeventはjsonと同じ形のmapのままで、fieldはmapのkeyとしてひく
+type eventTypeProvider struct {
+	ref.TypeProvider
+	eventType string
+	objects   map[string]map[string]*exprpb.Type
+}
+
+func newEventTypeProvider() (*eventTypeProvider, error) {
+	registry, err := types.NewRegistry()
+	if err != nil {
+		return nil, err
+	}
+	p := &eventTypeProvider{
+		TypeProvider: registry,
+		objects:      map[string]map[string]*exprpb.Type{},
+	}
+	p.eventType = p.objectType(reflect.TypeOf(v1.Event{})).GetMessageType()
+	return p, nil
+}
+
+func (p *eventTypeProvider) FindType(typeName string) (*exprpb.Type, bool) {
+	if _, ok := p.objects[typeName]; ok {
+		return decls.NewTypeType(decls.NewObjectType(typeName)), true
+	}
+	return p.TypeProvider.FindType(typeName)
+}
+
+func (p *eventTypeProvider) FindFieldType(messageType string, fieldName string) (*ref.FieldType, bool) {
+	fields, ok := p.objects[messageType]
+	if !ok {
+		return p.TypeProvider.FindFieldType(messageType, fieldName)
+	}
+	t, ok := fields[fieldName]
+	if !ok {
+		return nil, false
+	}
+	return &ref.FieldType{Type: t}, true
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	timeTypes         = map[reflect.Type]bool{
+		reflect.TypeOf(metav1.Time{}):      true,
+		reflect.TypeOf(metav1.MicroTime{}): true,
+	}
+)
+
+// celType はGoの型をjsonにした時のCELの型。時刻はjsonと同じ文字列
+func (p *eventTypeProvider) celType(t reflect.Type) *exprpb.Type {
+	if timeTypes[t] {
+		return decls.String
+	}
+	if t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType) {
+		return decls.Dyn
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return p.celType(t.Elem())
+	case reflect.String:
+		return decls.String
+	case reflect.Bool:
+		return decls.Bool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return decls.Int
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return decls.String
+		}
+		return decls.NewListType(p.celType(t.Elem()))
+	case reflect.Map:
+		return decls.NewMapType(decls.String, p.celType(t.Elem()))
+	case reflect.Struct:
+		return p.objectType(t)
+	}
+	return decls.Dyn
+}
+
+// objectType はstructをjsonのfield名のobject typeとして登録する
+func (p *eventTypeProvider) objectType(t reflect.Type) *exprpb.Type {
+	name := strings.ReplaceAll(t.PkgPath(), "/", ".") + "." + t.Name()
+	if _, ok := p.objects[name]; !ok {
+		fields := map[string]*exprpb.Type{}
+		p.objects[name] = fields
+		p.addFields(fields, t)
+	}
+	return decls.NewObjectType(name)
+}
+
+func (p *eventTypeProvider) addFields(fields map[string]*exprpb.Type, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		inline := len(tag) > 1 && tag[1] == "inline"
+		if f.Anonymous && (inline || tag[0] == "") && f.Type.Kind() == reflect.Struct {
+			p.addFields(fields, f.Type)
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = p.celType(f.Type)
+	}
+}
+
+// compileExpr は式をcompileして型checkする。同じ式はcacheしたものを返す
+func compileExpr(expr string) (cel.Program, error) {
+	celProgramsMu.Lock()
+	defer celProgramsMu.Unlock()
+	if p, ok := celPrograms[expr]; ok {
+		return p, nil
+	}
+	env, err := exprEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(expr)
+	if iss != nil && iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if t := ast.OutputType(); t != cel.BoolType && t != cel.DynType {
+		return nil, fmt.Errorf("expression must return bool, got %s", t)
+	}
+	p, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	celPrograms[expr] = p
+	return p, nil
+}
+
+// evalExpr はeventに対して式を評価する。評価できなければfalse
+func evalExpr(expr string, event *v1.Event) bool {
+	p, err := compileExpr(expr)
+	if err != nil {
+		glog.Errorf("Error compile expr : %s\n", err)
+		return false
+	}
+	m, err := eventToMap(event)
+	if err != nil {
+		glog.Errorf("Error convert event for expr : %s\n", err)
+		return false
+	}
+	out, _, err := p.Eval(map[string]interface{}{"event": m})
+	if err != nil {
+		if glog.V(1) {
+			glog.Infof("Error eval expr %q : %s", expr, err)
+		}
+		return false
+	}
+	b, ok := out.Value().(bool)
+	return ok && b
+}
+
+// eventToMap はeventをjsonと同じ形のmapにする。整数はint64にしてCELのintで比較できるようにする
+func eventToMap(event *v1.Event) (map[string]interface{}, error) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var m map[string]interface{}
+	if err := d.Decode(&m); err != nil {
+		return nil, err
+	}
+	return convertNumbers(m).(map[string]interface{}), nil
+}
+
+func convertNumbers(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			x[k] = convertNumbers(e)
+		}
+		return x
+	case []interface{}:
+		for i, e := range x {
+			x[i] = convertNumbers(e)
+		}
+		return x
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	default:
+		return v
+	}
+}
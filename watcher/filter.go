@@ -0,0 +1,414 @@
+package watcher
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// extraFilterのfilterで使えるoperator。指定がなければ文字列の部分一致か`/regex/`
+const (
+	opMatch  = ""
+	opEq     = "eq"
+	opNe     = "ne"
+	opGt     = "gt"
+	opLt     = "lt"
+	opIn     = "in"
+	opNotIn  = "notIn"
+	opExists = "exists"
+	opAgeGt  = "ageGt"
+	opAgeLt  = "ageLt"
+)
+
+var (
+	metav1TimeType      = reflect.TypeOf(metav1.Time{})
+	metav1MicroTimeType = reflect.TypeOf(metav1.MicroTime{})
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// resolveField は`InvolvedObject.Name`のようなkeyでeventのfieldをたどる
+// mapはkeyでひく（e.g. `ObjectMeta.Labels.app`）。時刻はそれ以上たどらない
+// `object.`と`owner.`で始まるkeyはinvolvedObjectのmetadataからひく
+func resolveField(event *v1.Event, key string) (reflect.Value, bool) {
+	if isObjectKey(key) {
+		s, ok := resolveObjectKey(event, key)
+		return reflect.ValueOf(s), ok
+	}
+	v := reflect.ValueOf(event).Elem()
+	for _, k := range strings.Split(key, ".") {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return v, false
+			}
+			v = v.Elem()
+		}
+		switch {
+		case v.Kind() == reflect.Struct && !isTimeType(v.Type()):
+			v = v.FieldByName(k)
+		case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+			v = v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))
+		default:
+			return v, false
+		}
+		if !v.IsValid() {
+			return v, false
+		}
+	}
+	return v, true
+}
+
+// validateFilterKey はkeyがv1.Eventのfieldとしてたどれるかを型で確認する
+func validateFilterKey(key string) error {
+	if isObjectKey(key) {
+		return validateObjectKey(key)
+	}
+	t := reflect.TypeOf(v1.Event{})
+	for _, k := range strings.Split(key, ".") {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch {
+		case t.Kind() == reflect.Struct && !isTimeType(t):
+			f, ok := t.FieldByName(k)
+			if !ok {
+				return fmt.Errorf("field %q not found in %s", k, t.Name())
+			}
+			t = f.Type
+		case t.Kind() == reflect.Map && t.Key().Kind() == reflect.String:
+			t = t.Elem()
+		default:
+			return fmt.Errorf("can't get %q of %s", k, t)
+		}
+	}
+	return nil
+}
+
+func isTimeType(t reflect.Type) bool {
+	return t == metav1TimeType || t == metav1MicroTimeType || t == timeType
+}
+
+func timeOf(v reflect.Value) (time.Time, bool) {
+	switch v.Type() {
+	case metav1TimeType:
+		return v.Interface().(metav1.Time).Time, true
+	case metav1MicroTimeType:
+		return v.Interface().(metav1.MicroTime).Time, true
+	case timeType:
+		return v.Interface().(time.Time), true
+	}
+	return time.Time{}, false
+}
+
+// matchFilter はeventがfilterの条件にmatchするかどうか
+func matchFilter(event *v1.Event, f filter) bool {
+	v, ok := resolveField(event, f.Key)
+	if f.Operator == opExists {
+		exists := ok && !v.IsZero()
+		if f.Value == "false" {
+			return !exists
+		}
+		return exists
+	}
+	if !ok {
+		return false
+	}
+	switch f.Operator {
+	case opMatch:
+		for _, s := range stringsOf(v) {
+			if matchString(f.Value, s) {
+				return true
+			}
+		}
+		return false
+	case opEq:
+		c, ok := compareValue(v, f.Value)
+		return ok && c == 0
+	case opNe:
+		c, ok := compareValue(v, f.Value)
+		return ok && c != 0
+	case opGt:
+		c, ok := compareValue(v, f.Value)
+		return ok && c > 0
+	case opLt:
+		c, ok := compareValue(v, f.Value)
+		return ok && c < 0
+	case opIn, opNotIn:
+		in := false
+		for _, s := range stringsOf(v) {
+			for _, x := range f.values() {
+				if s == x {
+					in = true
+				}
+			}
+		}
+		if f.Operator == opNotIn {
+			return !in
+		}
+		return in
+	case opAgeGt, opAgeLt:
+		t, ok := timeOf(v)
+		if !ok || t.IsZero() {
+			return false
+		}
+		d, err := time.ParseDuration(f.Value)
+		if err != nil {
+			return false
+		}
+		if f.Operator == opAgeGt {
+			return time.Since(t) > d
+		}
+		return time.Since(t) < d
+	}
+	return false
+}
+
+// values はin/notInの値。valuesの指定がなければvalueをカンマで区切る
+func (f filter) values() []string {
+	if len(f.Values) > 0 {
+		return f.Values
+	}
+	var vs []string
+	for _, s := range strings.Split(f.Value, ",") {
+		vs = append(vs, strings.TrimSpace(s))
+	}
+	return vs
+}
+
+// stringsOf はfieldを文字列にする。sliceなら要素ごと
+func stringsOf(v reflect.Value) []string {
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		var ss []string
+		for i := 0; i < v.Len(); i++ {
+			ss = append(ss, stringsOf(v.Index(i))...)
+		}
+		return ss
+	}
+	if t, ok := timeOf(v); ok {
+		if t.IsZero() {
+			return []string{""}
+		}
+		return []string{t.UTC().Format(time.RFC3339)}
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return []string{v.String()}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return []string{strconv.FormatInt(v.Int(), 10)}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return []string{strconv.FormatUint(v.Uint(), 10)}
+	case reflect.Float32, reflect.Float64:
+		return []string{strconv.FormatFloat(v.Float(), 'f', -1, 64)}
+	case reflect.Bool:
+		return []string{strconv.FormatBool(v.Bool())}
+	}
+	return []string{fmt.Sprint(v.Interface())}
+}
+
+// compareValue はfieldとvalueを比べて -1, 0, 1 を返す。数値と時刻(RFC3339)は値で、それ以外は文字列で比べる
+func compareValue(v reflect.Value, value string) (int, bool) {
+	if t, ok := timeOf(v); ok {
+		x, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return 0, false
+		}
+		switch {
+		case t.Before(x):
+			return -1, true
+		case t.After(x):
+			return 1, true
+		}
+		return 0, true
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return compareInt(v.Int(), x), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		switch {
+		case v.Uint() < x:
+			return -1, true
+		case v.Uint() > x:
+			return 1, true
+		}
+		return 0, true
+	case reflect.Float32, reflect.Float64:
+		x, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, false
+		}
+		switch {
+		case v.Float() < x:
+			return -1, true
+		case v.Float() > x:
+			return 1, true
+		}
+		return 0, true
+	case reflect.String:
+		return strings.Compare(v.String(), value), true
+	}
+	return 0, false
+}
+
+func compareInt(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// validateFilter はfilterのkey、operator、valueを確認する
+func validateFilter(f filter) []string {
+	var errs []string
+	if f.Key == "" {
+		errs = append(errs, "key: must be set")
+	} else if err := validateFilterKey(f.Key); err != nil {
+		errs = append(errs, fmt.Sprintf("key: %s", err))
+	}
+	switch f.Operator {
+	case opMatch:
+		if ptn, ok := regexPattern(f.Value); ok {
+			if _, err := regexp.Compile(ptn); err != nil {
+				errs = append(errs, fmt.Sprintf("value: %s", err))
+			}
+		}
+	case opEq, opNe, opIn, opNotIn:
+	case opGt, opLt:
+		if _, err := strconv.ParseFloat(f.Value, 64); err != nil {
+			if _, err := time.Parse(time.RFC3339, f.Value); err != nil {
+				errs = append(errs, fmt.Sprintf("value: must be a number or RFC3339 time for %s, got %q", f.Operator, f.Value))
+			}
+		}
+	case opExists:
+		switch f.Value {
+		case "", "true", "false":
+		default:
+			errs = append(errs, fmt.Sprintf("value: must be true or false for exists, got %q", f.Value))
+		}
+	case opAgeGt, opAgeLt:
+		if _, err := time.ParseDuration(f.Value); err != nil {
+			errs = append(errs, fmt.Sprintf("value: %s", err))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("operator: must be one of eq, ne, gt, lt, in, notIn, exists, ageGt, ageLt, got %q", f.Operator))
+	}
+	if len(f.Values) > 0 && f.Operator != opIn && f.Operator != opNotIn {
+		errs = append(errs, "values: can be set only for in and notIn")
+	}
+	return errs
+}
+
+// tree はextraFilterの条件を1つのtreeにする。条件がなければnil
+// filtersはconditionがandのものを全部満たすか、それ以外のどれか1つを満たせばmatchする
+// filters、match、exprは、keepなら全部満たすもの、dropならどれかを満たすものがmatch
+func (ef extraFilter) tree() *filterNode {
+	var parts []filterNode
+	if len(ef.Filters) > 0 {
+		var and []filterNode
+		var or []filterNode
+		for _, f := range ef.Filters {
+			if f.Condition == "and" {
+				and = append(and, filterNode{filter: f})
+			} else {
+				or = append(or, filterNode{filter: f})
+			}
+		}
+		if len(and) > 0 {
+			or = append(or, filterNode{All: and})
+		}
+		parts = append(parts, filterNode{Any: or})
+	}
+	if ef.Match != nil {
+		parts = append(parts, *ef.Match)
+	}
+	if ef.Expr != "" {
+		parts = append(parts, filterNode{Expr: ef.Expr})
+	}
+	switch {
+	case len(parts) == 0:
+		return nil
+	case len(parts) == 1:
+		return &parts[0]
+	case ef.Type == "keep":
+		return &filterNode{All: parts}
+	default:
+		return &filterNode{Any: parts}
+	}
+}
+
+// eval はeventが条件にmatchするかどうか
+func (n filterNode) eval(event *v1.Event) bool {
+	switch {
+	case len(n.All) > 0:
+		for _, c := range n.All {
+			if !c.eval(event) {
+				return false
+			}
+		}
+		return true
+	case len(n.Any) > 0:
+		for _, c := range n.Any {
+			if c.eval(event) {
+				return true
+			}
+		}
+		return false
+	case n.Not != nil:
+		return !n.Not.eval(event)
+	case n.Expr != "":
+		return evalExpr(n.Expr, event)
+	default:
+		return matchFilter(event, n.filter)
+	}
+}
+
+func validateFilterNode(path string, n filterNode) []string {
+	var errs []string
+	kinds := 0
+	for _, set := range []bool{len(n.All) > 0, len(n.Any) > 0, n.Not != nil, n.Expr != "", n.Key != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return append(errs, fmt.Sprintf("%s: must have exactly one of all, any, not, expr or key", path))
+	}
+	if n.Condition != "" {
+		errs = append(errs, fmt.Sprintf("%s.condition: can't be used in match, use all or any", path))
+	}
+	for i, c := range n.All {
+		errs = append(errs, validateFilterNode(fmt.Sprintf("%s.all[%d]", path, i), c)...)
+	}
+	for i, c := range n.Any {
+		errs = append(errs, validateFilterNode(fmt.Sprintf("%s.any[%d]", path, i), c)...)
+	}
+	if n.Not != nil {
+		errs = append(errs, validateFilterNode(path+".not", *n.Not)...)
+	}
+	if n.Expr != "" {
+		if _, err := compileExpr(n.Expr); err != nil {
+			errs = append(errs, fmt.Sprintf("%s.expr: %s", path, err))
+		}
+	}
+	if n.Key != "" {
+		for _, e := range validateFilter(n.filter) {
+			errs = append(errs, fmt.Sprintf("%s.%s", path, e))
+		}
+	}
+	return errs
+}
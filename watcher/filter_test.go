@@ -0,0 +1,160 @@
+package watcher
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// legacyExFiltering はall/any/notを入れる前のcounterでの判定。tree()が同じ結果になることを確かめる
+func legacyExFiltering(event *v1.Event, exFilter extraFilter) bool {
+	if len(exFilter.Filters) == 0 {
+		return false
+	}
+	andCondCnt := 0
+	andMatchCnt := 0
+	for _, f := range exFilter.Filters {
+		if f.Condition == "and" {
+			andCondCnt++
+		}
+	}
+	for _, f := range exFilter.Filters {
+		if !matchFilter(event, f) {
+			continue
+		}
+		switch exFilter.Type {
+		case "keep":
+			if f.Condition != "and" {
+				return false
+			}
+			andMatchCnt++
+			if andMatchCnt == andCondCnt {
+				return false
+			}
+		case "drop":
+			if f.Condition != "and" {
+				return true
+			}
+			andMatchCnt++
+			if andMatchCnt == andCondCnt {
+				return true
+			}
+		}
+	}
+	return exFilter.Type == "keep"
+}
+
+func TestExtraFilterTreeMatchesLegacy(t *testing.T) {
+	reason := func(v string, cond string) filter {
+		return filter{Key: "Reason", Value: v, Condition: cond}
+	}
+	kind := func(v string, cond string) filter {
+		return filter{Key: "InvolvedObject.Kind", Value: v, Condition: cond}
+	}
+	ns := func(v string, cond string) filter {
+		return filter{Key: "InvolvedObject.Namespace", Value: v, Condition: cond}
+	}
+	filterSets := []struct {
+		name    string
+		filters []filter
+	}{
+		{"single or", []filter{reason("BackOff", "")}},
+		{"two or", []filter{reason("BackOff", ""), kind("Node", "or")}},
+		{"single and", []filter{reason("BackOff", "and")}},
+		{"two and", []filter{reason("BackOff", "and"), kind("Pod", "and")}},
+		{"and then or", []filter{reason("BackOff", "and"), kind("Pod", "and"), ns("kube-system", "")}},
+		{"or then and", []filter{ns("kube-system", ""), reason("BackOff", "and"), kind("Pod", "and")}},
+		{"interleaved", []filter{reason("/^Fail/", "and"), ns("default", "or"), kind("Pod", "and"), reason("Killing", "")}},
+	}
+	events := []*v1.Event{
+		testEvent("default", "Pod", "BackOff"),
+		testEvent("default", "Pod", "Killing"),
+		testEvent("default", "Node", "BackOff"),
+		testEvent("kube-system", "Pod", "Pulled"),
+		testEvent("kube-system", "Node", "FailedMount"),
+		testEvent("default", "Pod", "FailedScheduling"),
+		testEvent("other", "Deployment", "ScalingReplicaSet"),
+	}
+	for _, typ := range []string{"keep", "drop"} {
+		for _, fs := range filterSets {
+			ef := extraFilter{Type: typ, Filters: fs.filters}
+			for _, e := range events {
+				want := legacyExFiltering(e, ef)
+				if got := exFiltering(e, ef); got != want {
+					t.Errorf("%s %s, %s/%s %s: got %v, want %v", typ, fs.name, e.InvolvedObject.Namespace, e.InvolvedObject.Kind, e.Reason, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestExFiltering(t *testing.T) {
+	backOff := filter{Key: "Reason", Value: "BackOff", Condition: "and"}
+	pod := filter{Key: "InvolvedObject.Kind", Value: "Pod", Condition: "and"}
+	system := filter{Key: "InvolvedObject.Namespace", Value: "kube-system"}
+	tests := []struct {
+		name   string
+		filter extraFilter
+		event  *v1.Event
+		want   bool
+	}{
+		{"keep and, all match", extraFilter{Type: "keep", Filters: []filter{backOff, pod}}, testEvent("default", "Pod", "BackOff"), false},
+		{"keep and, one match", extraFilter{Type: "keep", Filters: []filter{backOff, pod}}, testEvent("default", "Node", "BackOff"), true},
+		{"keep and or, or match", extraFilter{Type: "keep", Filters: []filter{backOff, pod, system}}, testEvent("kube-system", "Node", "Pulled"), false},
+		{"drop and, all match", extraFilter{Type: "drop", Filters: []filter{backOff, pod}}, testEvent("default", "Pod", "BackOff"), true},
+		{"drop and, one match", extraFilter{Type: "drop", Filters: []filter{backOff, pod}}, testEvent("default", "Pod", "Killing"), false},
+		{"drop and or, or match", extraFilter{Type: "drop", Filters: []filter{backOff, pod, system}}, testEvent("kube-system", "Node", "Pulled"), true},
+		{"keep match not", extraFilter{Type: "keep", Match: &filterNode{Not: &filterNode{filter: system}}}, testEvent("kube-system", "Pod", "BackOff"), true},
+		{"keep filters and match", extraFilter{Type: "keep", Filters: []filter{backOff}, Match: &filterNode{Any: []filterNode{{filter: pod}}}}, testEvent("default", "Node", "BackOff"), true},
+		{"drop filters or match", extraFilter{Type: "drop", Filters: []filter{backOff}, Match: &filterNode{filter: system}}, testEvent("kube-system", "Pod", "Pulled"), true},
+		{"no filters", extraFilter{Type: "keep"}, testEvent("default", "Pod", "BackOff"), false},
+	}
+	for _, tt := range tests {
+		if got := exFiltering(tt.event, tt.filter); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func testEvent(namespace string, kind string, reason string) *v1.Event {
+	return &v1.Event{
+		InvolvedObject: v1.ObjectReference{Namespace: namespace, Kind: kind, Name: "test"},
+		Reason:         reason,
+		Type:           "Normal",
+	}
+}
+
+func TestValidateObjectKeyNeedsObjectMetadata(t *testing.T) {
+	defer func(m bool, a bool) { *objectMetadata, *objectAnnotations = m, a }(*objectMetadata, *objectAnnotations)
+	cf := Config{
+		ExtraFilter: extraFilter{Type: "keep", Match: &filterNode{filter: filter{Key: "object.labels.tier", Value: "prod"}}},
+		Escalations: []escalation{{Name: "owner", GroupBy: []string{"owner.labels.app"}, Threshold: 1}},
+	}
+	tests := []struct {
+		objectMetadata    bool
+		objectAnnotations bool
+		wantErr           bool
+	}{
+		{false, false, true},
+		{true, false, false},
+		{false, true, false},
+	}
+	for _, tt := range tests {
+		*objectMetadata, *objectAnnotations = tt.objectMetadata, tt.objectAnnotations
+		for _, key := range []string{"object.labels.tier", "owner.annotations.team"} {
+			if err := validateFilterKey(key); (err != nil) != tt.wantErr {
+				t.Errorf("%s with objectMetadata=%v objectAnnotations=%v: got error %v, want error %v", key, tt.objectMetadata, tt.objectAnnotations, err, tt.wantErr)
+			}
+		}
+		var keyErrs []string
+		for _, e := range validateEntry(cf) {
+			if strings.Contains(e, "needs -objectMetadata") {
+				keyErrs = append(keyErrs, e)
+			}
+		}
+		if tt.wantErr && len(keyErrs) != 2 || !tt.wantErr && len(keyErrs) != 0 {
+			t.Errorf("validateEntry with objectMetadata=%v objectAnnotations=%v: got %v", tt.objectMetadata, tt.objectAnnotations, keyErrs)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package watcher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultFlappingTransitions = 4
+	defaultFlappingWindow      = "10m"
+)
+
+// flapping はobjectがreasonの間を行き来しているのを検出する設定。kindごとに指定する
+// windowの間にreasonがtransitions回以上変わったらflappingとして1回だけ通知し、
+// windowの間reasonが変わらなくなるまで個々のeventは通知しない
+type flapping struct {
+	Kind        string   `yaml:"kind"`
+	Reasons     []string `yaml:"reasons"`
+	Transitions int      `yaml:"transitions"`
+	Window      string   `yaml:"window"`
+}
+
+func (f flapping) transitions() int {
+	if f.Transitions == 0 {
+		return defaultFlappingTransitions
+	}
+	return f.Transitions
+}
+
+func (f flapping) window() time.Duration {
+	w := f.Window
+	if w == "" {
+		w = defaultFlappingWindow
+	}
+	d, _ := time.ParseDuration(w)
+	return d
+}
+
+func (f flapping) hasReason(reason string) bool {
+	for _, r := range f.Reasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func validateFlapping(f flapping) []string {
+	var errs []string
+	if f.Kind == "" {
+		errs = append(errs, "kind: must be set")
+	}
+	if len(f.Reasons) < 2 {
+		errs = append(errs, "reasons: must have two or more reasons")
+	}
+	if f.Transitions < 0 || f.Transitions == 1 {
+		errs = append(errs, fmt.Sprintf("transitions: must be 2 or more, got %d", f.Transitions))
+	}
+	if f.Window != "" {
+		if d, err := time.ParseDuration(f.Window); err != nil {
+			errs = append(errs, fmt.Sprintf("window: %s", err))
+		} else if d <= 0 {
+			errs = append(errs, fmt.Sprintf("window: must be positive, got %q", f.Window))
+		}
+	}
+	return errs
+}
+
+// flappingDetector はentryのflappingの設定でobjectごとのreasonの変化を追う
+type flappingDetector struct {
+	rules   []flapping
+	mu      sync.Mutex
+	objects map[string]*flappingObject
+	slack   slackConfig
+	cwlogs  cwLogConfig
+	// key はflappingDetectorsのkey。refsはこの検出器を使っているcontrollerの数
+	key  string
+	refs int
+}
+
+type flappingObject struct {
+	name        string
+	last        string
+	transitions []time.Time
+	reasons     map[string]bool
+	flapping    bool
+	// announced はflappingの通知を送ったかどうか。送っていなければstableの通知も送らない
+	announced  bool
+	suppressed int
+	changed    time.Time
+	timer      *time.Timer
+	// quiet は最後のeventのnamespaceのmute、silence、scheduleを通知の時に確かめる
+	quiet func() bool
+}
+
+var (
+	flappingDetectorsMu sync.Mutex
+	flappingDetectors   = map[string]*flappingDetector{}
+)
+
+// flappingFor はentryのflappingの検出器。同じ設定はnamespaceごとのcontrollerとreloadで共有する
+func flappingFor(cf Config, sc slackConfig, lc cwLogConfig) *flappingDetector {
+	if len(cf.Flapping) == 0 {
+		return nil
+	}
+	b, _ := yaml.Marshal(cf.Flapping)
+	key := fmt.Sprintf("%s/%s/%s", b, sc.Channel, lc.CWLogStream)
+	flappingDetectorsMu.Lock()
+	defer flappingDetectorsMu.Unlock()
+	d, ok := flappingDetectors[key]
+	if !ok {
+		d = &flappingDetector{
+			rules:   cf.Flapping,
+			objects: map[string]*flappingObject{},
+			key:     key,
+		}
+		flappingDetectors[key] = d
+	}
+	d.refs++
+	d.mu.Lock()
+	d.slack, d.cwlogs = sc, lc
+	d.mu.Unlock()
+	return d
+}
+
+// release はcontrollerが止まった時に呼ぶ。どのcontrollerも使わなくなったら検出器のtimerを止めて消す
+func (d *flappingDetector) release() {
+	if d == nil {
+		return
+	}
+	flappingDetectorsMu.Lock()
+	defer flappingDetectorsMu.Unlock()
+	d.refs--
+	if d.refs > 0 {
+		return
+	}
+	delete(flappingDetectors, d.key)
+	d.mu.Lock()
+	for key, obj := range d.objects {
+		if obj.timer != nil {
+			obj.timer.Stop()
+		}
+		delete(d.objects, key)
+	}
+	d.mu.Unlock()
+}
+
+func (d *flappingDetector) rule(e *v1.Event) (flapping, bool) {
+	for _, r := range d.rules {
+		if r.Kind == e.InvolvedObject.Kind && r.hasReason(e.Reason) {
+			return r, true
+		}
+	}
+	return flapping{}, false
+}
+
+// observe はeventのreasonの変化を記録する。flapping中で個々のeventを通知しない場合はtrue
+// quietがtrueを返す間は、eventと同じようにflappingの通知も送らない
+func (d *flappingDetector) observe(e *v1.Event, quiet func() bool) bool {
+	if d == nil {
+		return false
+	}
+	r, ok := d.rule(e)
+	if !ok {
+		return false
+	}
+	o := e.InvolvedObject
+	key := fmt.Sprintf("%s/%s/%s/%s", o.Kind, o.Namespace, o.Name, o.UID)
+	now := time.Now()
+	window := r.window()
+
+	d.mu.Lock()
+	obj, ok := d.objects[key]
+	if !ok {
+		obj = &flappingObject{
+			name:    fmt.Sprintf("%s %s/%s", o.Kind, o.Namespace, o.Name),
+			reasons: map[string]bool{},
+		}
+		d.objects[key] = obj
+	}
+	changed := !ok
+	if obj.last != "" && obj.last != e.Reason {
+		obj.transitions = append(obj.transitions, now)
+		obj.reasons[obj.last] = true
+		obj.reasons[e.Reason] = true
+		changed = true
+	}
+	obj.last = e.Reason
+	obj.quiet = quiet
+	i := 0
+	for i < len(obj.transitions) && now.Sub(obj.transitions[i]) > window {
+		i++
+	}
+	obj.transitions = obj.transitions[i:]
+
+	// windowの間reasonが変わらなければstableとする
+	if changed {
+		obj.changed = now
+		if obj.timer != nil {
+			obj.timer.Stop()
+		}
+		obj.timer = time.AfterFunc(window, func() { d.stable(key, window) })
+	}
+
+	started := false
+	if !obj.flapping && len(obj.transitions) >= r.transitions() {
+		obj.flapping = true
+		started = true
+	}
+	flappingNow := obj.flapping
+	if flappingNow && !started {
+		obj.suppressed++
+	}
+	announce := flappingNow && !obj.announced && !quiet()
+	if announce {
+		obj.announced = true
+	}
+	count := len(obj.transitions)
+	reasons := sortedKeys(obj.reasons)
+	sc, lc := d.slack, d.cwlogs
+	d.mu.Unlock()
+
+	if announce {
+		msg := fmt.Sprintf("%s is flapping between %s (%d transitions in %s)",
+			obj.name, strings.Join(reasons, ", "), count, humanDuration(window))
+		d.notify(msg, "flapping", "Warning", sc, lc)
+	}
+	return flappingNow
+}
+
+// stable はwindowの間reasonが変わらなかったobjectのflappingを終わらせる
+func (d *flappingDetector) stable(key string, window time.Duration) {
+	d.mu.Lock()
+	obj, ok := d.objects[key]
+	// timerが止まる前に発火していた場合
+	if !ok || time.Since(obj.changed) < window {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.objects, key)
+	name, announced, suppressed, quiet := obj.name, obj.announced, obj.suppressed, obj.quiet
+	sc, lc := d.slack, d.cwlogs
+	d.mu.Unlock()
+
+	if announced && !quiet() {
+		msg := fmt.Sprintf("%s is stable for %s, stopped flapping (%d events suppressed)", name, humanDuration(window), suppressed)
+		d.notify(msg, "stable", "Normal", sc, lc)
+	}
+}
+
+func (d *flappingDetector) notify(msg string, action string, status string, sc slackConfig, lc cwLogConfig) {
+	glog.Infoln(msg)
+	if err := sendToSlack("", msg, action, status, sc); err != nil {
+		glog.Errorf("Error post flapping to slack : %s\n", err)
+	}
+	if err := postEventToCWLogs(msg, action, lc); err != nil {
+		glog.Errorf("Error send flapping to cloudwatch logs : %s\n", err)
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
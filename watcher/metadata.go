@@ -0,0 +1,298 @@
+package watcher
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	defaultObjectMetadata = false
+	// informerのcache syncを待つ上限
+	metadataSyncTimeout = 30 * time.Second
+	// syncしなかったresourceをひき直すまでの時間。失敗するたびに倍にする
+	metadataRetryBackoff    = time.Minute
+	metadataMaxRetryBackoff = 30 * time.Minute
+	// discoveryのやり直しの間隔
+	mapperResetInterval = time.Minute
+	// ownerReferencesをたどる上限
+	maxOwnerDepth = 5
+)
+
+var (
+	objectMetadata = flag.Bool("objectMetadata", defaultObjectMetadata, "Whether to watch metadata of involved objects to filter and route events by their labels and annotations.")
+)
+
+// filterのkeyでinvolvedObjectとそのownerのlabelとannotationを指定する
+// e.g. `object.labels.tier`、`owner.annotations.example.com/team`
+const (
+	objectKeyPrefix = "object."
+	ownerKeyPrefix  = "owner."
+	labelsKey       = "labels."
+	annotationsKey  = "annotations."
+)
+
+// objectMetaCache はinvolvedObjectのmetadataだけを持つinformerのcache。resourceごとに必要になった時に起動する
+type objectMetaCache struct {
+	client    metadata.Interface
+	mapper    *restmapper.DeferredDiscoveryRESTMapper
+	mu        sync.Mutex
+	informers map[schema.GroupVersionResource]*metaInformer
+	lastReset time.Time
+	stopped   bool
+}
+
+// metaInformer はresourceごとのinformer。listの権限がないなどでsyncしなければ止めて、backoffの後に起動し直す
+type metaInformer struct {
+	informer cache.SharedIndexInformer
+	stop     chan struct{}
+	// waited は最初のsyncを待ち終わったら閉じる
+	waited  chan struct{}
+	retryAt time.Time
+	backoff time.Duration
+}
+
+// objectMetadataEnabled はmetadataCacheを作るかどうか
+func objectMetadataEnabled() bool {
+	return *objectMetadata || *objectAnnotations
+}
+
+// metadataCache は-objectMetadataか-objectAnnotationsの時だけ作られる
+var metadataCache *objectMetaCache
+
+func startObjectMetaCache(config *rest.Config) {
+	client, err := metadata.NewForConfig(config)
+	if err != nil {
+		panic(err)
+	}
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		panic(err)
+	}
+	metadataCache = &objectMetaCache{
+		client:    client,
+		mapper:    restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc)),
+		informers: map[schema.GroupVersionResource]*metaInformer{},
+	}
+	glog.Infoln("enable object metadata cache")
+}
+
+func stopObjectMetaCache() {
+	if metadataCache == nil {
+		return
+	}
+	c := metadataCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	for _, mi := range c.informers {
+		if mi.informer != nil {
+			close(mi.stop)
+			mi.informer = nil
+		}
+	}
+}
+
+// informer はresourceのinformer。syncを待つのはresourceごとに起動した時だけで、syncしていなければfalse
+func (c *objectMetaCache) informer(gvr schema.GroupVersionResource) (cache.SharedIndexInformer, bool) {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return nil, false
+	}
+	mi, ok := c.informers[gvr]
+	if !ok {
+		mi = &metaInformer{}
+		c.informers[gvr] = mi
+	}
+	if mi.informer == nil {
+		if time.Now().Before(mi.retryAt) {
+			c.mu.Unlock()
+			return nil, false
+		}
+		glog.Infof("Starting metadata informer for %s", gvr)
+		mi.informer = metadatainformer.NewFilteredMetadataInformer(c.client, gvr, metav1.NamespaceAll, 0, cache.Indexers{}, nil).Informer()
+		mi.stop = make(chan struct{})
+		mi.waited = make(chan struct{})
+		go mi.informer.Run(mi.stop)
+		go c.waitForSync(gvr, mi, mi.informer, mi.waited)
+	}
+	inf, waited := mi.informer, mi.waited
+	c.mu.Unlock()
+
+	<-waited
+	if !inf.HasSynced() {
+		return nil, false
+	}
+	return inf, true
+}
+
+// waitForSync はinformerのsyncを待つ。syncしなければinformerを止めて、backoffの間はそのresourceをひかない
+func (c *objectMetaCache) waitForSync(gvr schema.GroupVersionResource, mi *metaInformer, inf cache.SharedIndexInformer, waited chan struct{}) {
+	defer close(waited)
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(metadataSyncTimeout, func() { close(timeout) })
+	defer timer.Stop()
+	synced := cache.WaitForCacheSync(timeout, inf.HasSynced)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if synced {
+		mi.backoff = 0
+		return
+	}
+	if mi.informer != inf {
+		return
+	}
+	close(mi.stop)
+	mi.informer = nil
+	mi.backoff *= 2
+	if mi.backoff < metadataRetryBackoff {
+		mi.backoff = metadataRetryBackoff
+	}
+	if mi.backoff > metadataMaxRetryBackoff {
+		mi.backoff = metadataMaxRetryBackoff
+	}
+	mi.retryAt = time.Now().Add(mi.backoff)
+	glog.Warningf("metadata cache of %s didn't sync in %s, retry after %s. Check the permission to list it", gvr, metadataSyncTimeout, mi.backoff)
+}
+
+// resetMapper はdiscoveryをやり直す。CRDが後から追加されたかもしれないので、mapにないkindがあれば一定間隔でやり直す
+func (c *objectMetaCache) resetMapper() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.lastReset) < mapperResetInterval {
+		return
+	}
+	c.lastReset = time.Now()
+	c.mapper.Reset()
+}
+
+// get はapiVersion、kind、namespace、nameでobjectのmetadataをひく
+func (c *objectMetaCache) get(apiVersion string, kind string, namespace string, name string) (*metav1.PartialObjectMetadata, bool) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, false
+	}
+	mapping, err := c.mapper.RESTMapping(schema.GroupKind{Group: gv.Group, Kind: kind}, gv.Version)
+	if err != nil {
+		c.resetMapper()
+		if glog.V(1) {
+			glog.Infof("can't find resource of %s %s : %s", apiVersion, kind, err)
+		}
+		return nil, false
+	}
+	key := name
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		key = namespace + "/" + name
+	}
+	inf, ok := c.informer(mapping.Resource)
+	if !ok {
+		return nil, false
+	}
+	obj, ok, err := inf.GetStore().GetByKey(key)
+	if err != nil || !ok {
+		return nil, false
+	}
+	m, ok := obj.(*metav1.PartialObjectMetadata)
+	return m, ok
+}
+
+// involvedObject はeventのinvolvedObjectのmetadata
+func (c *objectMetaCache) involvedObject(event *v1.Event) (*metav1.PartialObjectMetadata, bool) {
+	ref := event.InvolvedObject
+	return c.get(ref.APIVersion, ref.Kind, ref.Namespace, ref.Name)
+}
+
+// owners はownerReferencesをたどったobject。近い順で、最後が一番上のobject。e.g. Pod -> ReplicaSet -> Deployment
+func (c *objectMetaCache) owners(obj *metav1.PartialObjectMetadata) []*metav1.PartialObjectMetadata {
+	var owners []*metav1.PartialObjectMetadata
+	cur := obj
+	for i := 0; i < maxOwnerDepth; i++ {
+		refs := cur.GetOwnerReferences()
+		if len(refs) == 0 {
+			break
+		}
+		ref := refs[0]
+		if ctrl := metav1.GetControllerOfNoCopy(cur); ctrl != nil {
+			ref = *ctrl
+		}
+		o, ok := c.get(ref.APIVersion, ref.Kind, cur.GetNamespace(), ref.Name)
+		if !ok {
+			break
+		}
+		owners = append(owners, o)
+		cur = o
+	}
+	return owners
+}
+
+// owner はownerReferencesをたどった一番上のobject
+func (c *objectMetaCache) owner(obj *metav1.PartialObjectMetadata) (*metav1.PartialObjectMetadata, bool) {
+	owners := c.owners(obj)
+	if len(owners) == 0 {
+		return nil, false
+	}
+	return owners[len(owners)-1], true
+}
+
+// resolveObjectKey は`object.`と`owner.`で始まるkeyの値をひく
+func resolveObjectKey(event *v1.Event, key string) (string, bool) {
+	if metadataCache == nil {
+		return "", false
+	}
+	obj, ok := metadataCache.involvedObject(event)
+	if !ok {
+		return "", false
+	}
+	rest := strings.TrimPrefix(key, objectKeyPrefix)
+	if strings.HasPrefix(key, ownerKeyPrefix) {
+		obj, ok = metadataCache.owner(obj)
+		if !ok {
+			return "", false
+		}
+		rest = strings.TrimPrefix(key, ownerKeyPrefix)
+	}
+	switch {
+	case strings.HasPrefix(rest, labelsKey):
+		v, ok := obj.GetLabels()[strings.TrimPrefix(rest, labelsKey)]
+		return v, ok
+	case strings.HasPrefix(rest, annotationsKey):
+		v, ok := obj.GetAnnotations()[strings.TrimPrefix(rest, annotationsKey)]
+		return v, ok
+	}
+	return "", false
+}
+
+func isObjectKey(key string) bool {
+	return strings.HasPrefix(key, objectKeyPrefix) || strings.HasPrefix(key, ownerKeyPrefix)
+}
+
+func validateObjectKey(key string) error {
+	// metadataCacheがないとmatchしないので、keepのfilterなら全部のeventを落としてしまう
+	if !objectMetadataEnabled() {
+		return fmt.Errorf("%q needs -objectMetadata", key)
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(key, objectKeyPrefix), ownerKeyPrefix)
+	for _, p := range []string{labelsKey, annotationsKey} {
+		if strings.HasPrefix(rest, p) && len(rest) > len(p) {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be labels.<key> or annotations.<key> of object or owner, got %q", key)
+}
@@ -0,0 +1,150 @@
+package watcher
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Namespaceのannotationで通知先を変える
+const (
+	annotationSlackChannel = "kube-event-watcher/slack-channel"
+	annotationLogStream    = "kube-event-watcher/log-stream"
+	annotationMute         = "kube-event-watcher/mute"
+)
+
+const (
+	defaultNamespaceAnnotations = false
+)
+
+var (
+	namespaceAnnotations = flag.Bool("namespaceAnnotations", defaultNamespaceAnnotations, "Whether to route events by annotations of namespaces.")
+)
+
+// namespaceCache はNamespaceのinformer。namespaceSelectorなどで必要になった時に起動する
+type namespaceCache struct {
+	client   kubernetes.Interface
+	once     sync.Once
+	informer cache.SharedIndexInformer
+	stopCh   chan struct{}
+	mu       sync.Mutex
+	handlers []func()
+}
+
+func newNamespaceCache(client kubernetes.Interface) *namespaceCache {
+	return &namespaceCache{
+		client: client,
+		stopCh: make(chan struct{}),
+	}
+}
+
+// onChange はNamespaceが追加・更新・削除された時に呼ぶ関数を登録する
+func (n *namespaceCache) onChange(f func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.handlers = append(n.handlers, f)
+}
+
+func (n *namespaceCache) notify() {
+	n.mu.Lock()
+	handlers := append([]func(){}, n.handlers...)
+	n.mu.Unlock()
+	for _, f := range handlers {
+		f()
+	}
+}
+
+// start はinformerを起動してcacheのsyncを待つ。2回目以降は何もしない
+func (n *namespaceCache) start() {
+	n.once.Do(func() {
+		lw := cache.NewListWatchFromClient(n.client.CoreV1().RESTClient(), "namespaces", v1.NamespaceAll, fields.Everything())
+		n.informer = cache.NewSharedIndexInformer(lw, &v1.Namespace{}, 0, cache.Indexers{})
+		n.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				n.notify()
+			},
+			UpdateFunc: func(old, new interface{}) {
+				o, ok1 := old.(*v1.Namespace)
+				nn, ok2 := new.(*v1.Namespace)
+				if ok1 && ok2 && o.ResourceVersion == nn.ResourceVersion {
+					return
+				}
+				n.notify()
+			},
+			DeleteFunc: func(obj interface{}) {
+				n.notify()
+			},
+		})
+		glog.Infoln("Starting Namespace informer")
+		go n.informer.Run(n.stopCh)
+		if !cache.WaitForCacheSync(n.stopCh, n.informer.HasSynced) {
+			runtime.HandleError(fmt.Errorf("Timed out waiting for namespace cache to sync"))
+		}
+	})
+}
+
+func (n *namespaceCache) stop() {
+	close(n.stopCh)
+}
+
+// matching はlabel selectorにmatchするnamespace
+func (n *namespaceCache) matching(selector k8slabels.Selector) []string {
+	n.start()
+	var names []string
+	for _, obj := range n.informer.GetStore().List() {
+		ns, ok := obj.(*v1.Namespace)
+		if !ok {
+			continue
+		}
+		if selector.Matches(k8slabels.Set(ns.Labels)) {
+			names = append(names, ns.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// get はcacheからNamespaceを取り出す。なければnil
+func (n *namespaceCache) get(name string) *v1.Namespace {
+	n.start()
+	obj, ok, err := n.informer.GetStore().GetByKey(name)
+	if err != nil || !ok {
+		return nil
+	}
+	ns, ok := obj.(*v1.Namespace)
+	if !ok {
+		return nil
+	}
+	return ns
+}
+
+// routeByNamespace はNamespaceのannotationで通知先を上書きする。muteならtrueを返す
+// annotationはConfigのchannelとlogStreamより優先する
+func routeByNamespace(n *namespaceCache, namespace string, sc slackConfig, lc cwLogConfig) (slackConfig, cwLogConfig, bool) {
+	if n == nil || !*namespaceAnnotations || namespace == "" {
+		return sc, lc, false
+	}
+	ns := n.get(namespace)
+	if ns == nil {
+		return sc, lc, false
+	}
+	if ns.Annotations[annotationMute] == "true" {
+		return sc, lc, true
+	}
+	if ch := ns.Annotations[annotationSlackChannel]; ch != "" {
+		sc.Channel = ch
+	}
+	if st := ns.Annotations[annotationLogStream]; st != "" {
+		lc.CWLogStream = st
+	}
+	return sc, lc, false
+}
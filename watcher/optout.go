@@ -0,0 +1,64 @@
+package watcher
+
+import (
+	"flag"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// PodやDeployment、Namespaceのannotationでそのobjectのeventを止めたり、必ず通知したりする
+const (
+	annotationIgnoreReasons = "kube-event-watcher/ignore-reasons"
+	annotationNotify        = "kube-event-watcher/notify"
+	notifyAlways            = "always"
+)
+
+const (
+	defaultObjectAnnotations = false
+)
+
+var (
+	objectAnnotations = flag.Bool("objectAnnotations", defaultObjectAnnotations, "Whether to suppress or force events by annotations of involved objects, their owners and namespaces.")
+)
+
+// optOut はinvolvedObject、そのowner、Namespaceのannotationをみる
+// ignoreはignore-reasonsにreasonが含まれる場合、forceはnotify: alwaysの場合。forceはignoreより優先する
+func optOut(n *namespaceCache, event *v1.Event) (ignore bool, force bool) {
+	if !*objectAnnotations {
+		return false, false
+	}
+	var annotations []map[string]string
+	if metadataCache != nil {
+		if obj, ok := metadataCache.involvedObject(event); ok {
+			annotations = append(annotations, obj.GetAnnotations())
+			for _, o := range metadataCache.owners(obj) {
+				annotations = append(annotations, o.GetAnnotations())
+			}
+		}
+	}
+	if n != nil && event.InvolvedObject.Namespace != "" {
+		if ns := n.get(event.InvolvedObject.Namespace); ns != nil {
+			annotations = append(annotations, ns.Annotations)
+		}
+	}
+	for _, a := range annotations {
+		if a[annotationNotify] == notifyAlways {
+			return false, true
+		}
+		if ignoreReason(a[annotationIgnoreReasons], event.Reason) {
+			ignore = true
+		}
+	}
+	return ignore, false
+}
+
+// ignoreReason はカンマ区切りのreasonsにreasonが含まれるかどうか
+func ignoreReason(reasons string, reason string) bool {
+	for _, r := range strings.Split(reasons, ",") {
+		if r = strings.TrimSpace(r); r != "" && r == reason {
+			return true
+		}
+	}
+	return false
+}
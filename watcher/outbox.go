@@ -0,0 +1,473 @@
+package watcher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/golang/glog"
+	"github.com/slack-go/slack"
+)
+
+const (
+	defaultOutboxMaxAge     = 24 * time.Hour
+	defaultOutboxMaxBackoff = 5 * time.Minute
+	// outboxInitialBackoff は最初の再送までの時間。失敗するたびに倍にする
+	outboxInitialBackoff = time.Second
+)
+
+var (
+	outboxDir        = flag.String("outboxDir", "", "Directory to persist messages before delivery. Messages are retried per destination and replayed on restart.")
+	outboxMaxAge     = flag.Duration("outboxMaxAge", defaultOutboxMaxAge, "Messages in the outbox older than this are dropped.")
+	outboxMaxBackoff = flag.Duration("outboxMaxBackoff", defaultOutboxMaxBackoff, "Max interval of retries of a message in the outbox.")
+)
+
+// outboxItem はoutboxに保存する1件のmessage。SlackかCWLogsのどちらか
+type outboxItem struct {
+	Output   string      `json:"output"`
+	Created  time.Time   `json:"created"`
+	Attempts int         `json:"attempts"`
+	Slack    *slackPost  `json:"slack,omitempty"`
+	CWLogs   *cwLogsPost `json:"cwlogs,omitempty"`
+}
+
+// destination は送信先。送信先ごとに順番に送って、送信先ごとに再送する
+func (i outboxItem) destination() string {
+	switch {
+	case i.Slack != nil:
+		return i.Slack.Channel
+	case i.CWLogs != nil:
+		return i.CWLogs.Group + "/" + i.CWLogs.Stream
+	}
+	return ""
+}
+
+// queueKey はqueueを分けるkey。Slackは同じ名前のchannelでもworkspace（token）が違えば別のqueueにする
+func (i outboxItem) queueKey() string {
+	if i.Slack != nil {
+		return i.Output + "/" + i.Slack.TokenRef + "/" + i.destination()
+	}
+	return i.Output + "/" + i.destination()
+}
+
+// outbox は送信先ごとのWAL（追記だけのlog file）にmessageを書いて、送れたらそのことを追記する
+type outbox struct {
+	dir    string
+	mu     sync.Mutex
+	queues map[string]*outboxQueue
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// outboxQueue は1つの送信先のmessage。送っていないmessageはmemoryにも持ち、workerが古い順に送る
+type outboxQueue struct {
+	outbox      *outbox
+	output      string
+	destination string
+	path        string
+	notify      chan struct{}
+	mu          sync.Mutex
+	file        *os.File
+	pending     []pendingItem
+	nextID      uint64
+	// records はWALの行数。送り終えたmessageの行が多くなったらWALを書き直す
+	records int
+}
+
+type pendingItem struct {
+	id   uint64
+	item outboxItem
+}
+
+// walRecord はWALの1行。putでmessageを追加して、retryで失敗した回数を更新して、doneで消す
+type walRecord struct {
+	Op       string      `json:"op"`
+	ID       uint64      `json:"id"`
+	Item     *outboxItem `json:"item,omitempty"`
+	Attempts int         `json:"attempts,omitempty"`
+}
+
+const (
+	walPut   = "put"
+	walRetry = "retry"
+	walDone  = "done"
+	walExt   = ".wal"
+	// walCompactRecords より行が多く、その半分以上が送り終えたmessageならWALを書き直す
+	walCompactRecords = 1000
+)
+
+// deliveryOutbox は-outboxDirの時だけ作られる。nilならその場で送る
+var deliveryOutbox *outbox
+
+// startOutbox はoutboxに残っているmessageを読み込んで、送信先ごとにworkerを起動する
+// 残っているSlackのmessageをすぐに送れるように、workerを起動する前に設定のtokenを登録する
+func startOutbox(conf []Config) error {
+	if *outboxDir == "" {
+		return nil
+	}
+	registerSlackTokens(conf)
+	if err := os.MkdirAll(*outboxDir, 0700); err != nil {
+		return fmt.Errorf("outbox error: %s", err)
+	}
+	o := &outbox{
+		dir:    *outboxDir,
+		queues: map[string]*outboxQueue{},
+		stopCh: make(chan struct{}),
+	}
+	paths, err := filepath.Glob(filepath.Join(o.dir, "*"+walExt))
+	if err != nil {
+		return fmt.Errorf("outbox error: %s", err)
+	}
+	total := 0
+	for _, path := range paths {
+		pending, _, err := readWAL(path)
+		if err != nil {
+			return fmt.Errorf("outbox error: %s: %s", path, err)
+		}
+		if len(pending) == 0 {
+			os.Remove(path)
+			continue
+		}
+		// 残っていたfileはそのまま使う。keyからfile名を作り直すと、keyの作り方が変わった時に読まれなくなる
+		if _, err := o.queue(pending[0].item, path); err != nil {
+			return fmt.Errorf("outbox error: %s", err)
+		}
+		total += len(pending)
+	}
+	glog.Infof("%d messages loaded from outbox %s", total, o.dir)
+	deliveryOutbox = o
+	return nil
+}
+
+// stop はworkerを止める。送れていないmessageは次の起動時に送る
+func (o *outbox) stop() {
+	if o == nil {
+		return
+	}
+	close(o.stopCh)
+	o.wg.Wait()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, q := range o.queues {
+		q.file.Close()
+	}
+}
+
+// queue はitemの送信先のqueue。なければWALを読み込んでworkerを起動する。pathが""ならkeyからfile名を作る
+func (o *outbox) queue(item outboxItem, path string) (*outboxQueue, error) {
+	key := item.queueKey()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if q, ok := o.queues[key]; ok {
+		return q, nil
+	}
+	if path == "" {
+		sum := sha256.Sum256([]byte(key))
+		path = filepath.Join(o.dir, item.Output+"-"+hex.EncodeToString(sum[:8])+walExt)
+	}
+	q := &outboxQueue{
+		outbox:      o,
+		output:      item.Output,
+		destination: item.destination(),
+		path:        path,
+		notify:      make(chan struct{}, 1),
+	}
+	pending, nextID, err := readWAL(q.path)
+	if err != nil {
+		return nil, err
+	}
+	q.pending, q.nextID = pending, nextID
+	// 読み込んだ時に送り終えたmessageの行と途中で切れた行を消す
+	if err := q.compactLocked(); err != nil {
+		return nil, err
+	}
+	eventWatcherOutboxPending.WithLabelValues(q.output, q.destination).Set(float64(len(q.pending)))
+	o.queues[key] = q
+	o.wg.Add(1)
+	go q.run()
+	return q, nil
+}
+
+// enqueue はmessageをWALに書いてから送信先のworkerに知らせる
+func (o *outbox) enqueue(item outboxItem) error {
+	item.Created = time.Now()
+	q, err := o.queue(item, "")
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	id := q.nextID
+	if err := q.appendLocked(walRecord{Op: walPut, ID: id, Item: &item}); err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	q.nextID++
+	q.pending = append(q.pending, pendingItem{id: id, item: item})
+	q.mu.Unlock()
+	eventWatcherOutboxPending.WithLabelValues(q.output, q.destination).Inc()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// run は古いmessageから順に送る。失敗したら同じmessageをbackoffして送り直すので、送信先の中の順番は変わらない
+func (q *outboxQueue) run() {
+	defer q.outbox.wg.Done()
+	for {
+		wait := q.deliverNext()
+		if wait < 0 {
+			select {
+			case <-q.notify:
+				continue
+			case <-q.outbox.stopCh:
+				return
+			}
+		}
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-q.outbox.stopCh:
+				return
+			}
+		}
+		select {
+		case <-q.outbox.stopCh:
+			return
+		default:
+		}
+	}
+}
+
+// deliverNext は一番古いmessageを送る。次に送るまで待つ時間を返す。messageがなければ-1
+// pendingから消すのはworkerだけなので、送っている間もpending[0]は同じmessage
+func (q *outboxQueue) deliverNext() time.Duration {
+	q.mu.Lock()
+	if len(q.pending) == 0 {
+		q.mu.Unlock()
+		return -1
+	}
+	head := q.pending[0]
+	q.mu.Unlock()
+
+	item := head.item
+	if time.Since(item.Created) > *outboxMaxAge {
+		glog.Errorf("outbox message to %s %s is older than %s, dropped", q.output, q.destination, *outboxMaxAge)
+		q.finish(head.id, "expired")
+		return 0
+	}
+	err := q.deliver(item)
+	if err == nil {
+		q.finish(head.id, "delivered")
+		return 0
+	}
+	if permanentDeliveryError(err) {
+		glog.Errorf("Error send outbox message to %s %s, dropped : %s\n", q.output, q.destination, err)
+		q.finish(head.id, "dropped")
+		return 0
+	}
+	item.Attempts++
+	q.mu.Lock()
+	q.pending[0].item.Attempts = item.Attempts
+	if e := q.appendLocked(walRecord{Op: walRetry, ID: head.id, Attempts: item.Attempts}); e != nil {
+		glog.Errorf("Error update outbox %s : %s\n", q.path, e)
+	}
+	q.mu.Unlock()
+	eventWatcherOutboxDeliveries.WithLabelValues(q.output, q.destination, "failed").Inc()
+	wait := outboxBackoff(item.Attempts)
+	var rl *slack.RateLimitedError
+	if errors.As(err, &rl) && rl.RetryAfter > wait {
+		wait = rl.RetryAfter
+	}
+	glog.Errorf("Error send outbox message to %s %s (attempt %d), retry in %s : %s\n", q.output, q.destination, item.Attempts, wait, err)
+	return wait
+}
+
+// deliver はrate limitを待ってから送る。outboxから送る時はrate limitで捨てずに待つ
+func (q *outboxQueue) deliver(item outboxItem) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-q.outbox.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	switch {
+	case item.Slack != nil:
+		token, err := resolveSlackToken(item.Slack.TokenRef)
+		if err != nil {
+			return err
+		}
+		if err := limiterFor(outputSlack, q.destination, *slackRateLimit, *slackRateBurst).wait(ctx); err != nil {
+			return err
+		}
+		return deliverSlackPost(*item.Slack, token)
+	case item.CWLogs != nil:
+		if err := limiterFor(outputCWLogs, q.destination, *cwlogsRateLimit, *cwlogsRateBurst).wait(ctx); err != nil {
+			return err
+		}
+		e := &cloudwatchlogs.InputLogEvent{
+			Message:   aws.String(item.CWLogs.Message),
+			Timestamp: aws.Int64(item.CWLogs.Timestamp),
+		}
+		return tokenAndPutWithRetry([]*cloudwatchlogs.InputLogEvent{e}, item.CWLogs.Group, item.CWLogs.Stream)
+	}
+	return errors.New("empty outbox item")
+}
+
+// finish は一番古いmessageを送り終えたことをWALに書いてpendingから消す
+func (q *outboxQueue) finish(id uint64, result string) {
+	q.mu.Lock()
+	if err := q.appendLocked(walRecord{Op: walDone, ID: id}); err != nil {
+		glog.Errorf("Error update outbox %s : %s\n", q.path, err)
+	}
+	q.pending = q.pending[1:]
+	if q.records > walCompactRecords && q.records > 2*len(q.pending) {
+		if err := q.compactLocked(); err != nil {
+			glog.Errorf("Error compact outbox %s : %s\n", q.path, err)
+		}
+	}
+	q.mu.Unlock()
+	eventWatcherOutboxPending.WithLabelValues(q.output, q.destination).Dec()
+	eventWatcherOutboxDeliveries.WithLabelValues(q.output, q.destination, result).Inc()
+}
+
+// appendLocked はWALに1行追記してsyncする。q.muの中で呼ぶ
+func (q *outboxQueue) appendLocked(r walRecord) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := q.file.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	q.records++
+	return q.file.Sync()
+}
+
+// compactLocked はWALをpendingのmessageだけで書き直して、追記用に開き直す。q.muの中で呼ぶ
+func (q *outboxQueue) compactLocked() error {
+	var buf bytes.Buffer
+	for i := range q.pending {
+		b, err := json.Marshal(walRecord{Op: walPut, ID: q.pending[i].id, Item: &q.pending[i].item})
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	if err := writeFileAtomic(q.path, buf.Bytes()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = f
+	q.records = len(q.pending)
+	return nil
+}
+
+// permanentDeliveryError は送り直しても送れないerror。送信先の後ろのmessageを止めないように捨てる
+// tokenRefのtokenが設定にない（tokenが変わった、entryが消えた）messageも送れるようにはならない
+func permanentDeliveryError(err error) bool {
+	if errors.Is(err, errSlackTokenNotFound) {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == cloudwatchlogs.ErrCodeInvalidParameterException
+	}
+	switch err.Error() {
+	case "channel_not_found", "is_archived", "msg_too_long", "invalid_arguments", "empty outbox item":
+		return true
+	}
+	return false
+}
+
+// outboxBackoff はattempts回失敗した後に待つ時間
+func outboxBackoff(attempts int) time.Duration {
+	d := outboxInitialBackoff
+	for i := 1; i < attempts && d < *outboxMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > *outboxMaxBackoff {
+		d = *outboxMaxBackoff
+	}
+	return d
+}
+
+// readWAL はWALを読んで、送っていないmessageを古い順に返す。最後の行が途中で切れていれば無視する
+func readWAL(path string) ([]pendingItem, uint64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	items := map[uint64]*outboxItem{}
+	var order []uint64
+	var nextID uint64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				glog.Warningf("outbox %s ends with an incomplete record, ignored", path)
+			}
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			glog.Errorf("Error read outbox %s, record ignored : %s\n", path, err)
+			continue
+		}
+		if rec.ID >= nextID {
+			nextID = rec.ID + 1
+		}
+		switch rec.Op {
+		case walPut:
+			if rec.Item != nil {
+				items[rec.ID] = rec.Item
+				order = append(order, rec.ID)
+			}
+		case walRetry:
+			if item, ok := items[rec.ID]; ok {
+				item.Attempts = rec.Attempts
+			}
+		case walDone:
+			delete(items, rec.ID)
+		}
+	}
+	var pending []pendingItem
+	for _, id := range order {
+		if item, ok := items[id]; ok {
+			pending = append(pending, pendingItem{id: id, item: *item})
+		}
+	}
+	return pending, nextID, nil
+}
@@ -0,0 +1,147 @@
+package watcher
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	defer func(d time.Duration) { *outboxMaxBackoff = d }(*outboxMaxBackoff)
+	*outboxMaxBackoff = time.Minute
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := outboxBackoff(tt.attempts); got != tt.want {
+			t.Errorf("attempts %d: got %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestReadWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "slack-test"+walExt)
+	// 最後の行は書き込み中に落ちた途中までのrecord
+	wal := `{"op":"put","id":0,"item":{"output":"slack"}}
+{"op":"put","id":1,"item":{"output":"slack"}}
+{"op":"retry","id":1,"attempts":3}
+{"op":"done","id":0}
+{"op":"put","id":2,"item":{"output":"slack"}}
+{"op":"put","id":3,"ite`
+	if err := ioutil.WriteFile(path, []byte(wal), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pending, nextID, err := readWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].id != 1 || pending[1].id != 2 {
+		t.Fatalf("pending: got %+v, want ids 1 and 2", pending)
+	}
+	if pending[0].item.Attempts != 3 {
+		t.Errorf("attempts: got %d, want 3", pending[0].item.Attempts)
+	}
+	if nextID != 3 {
+		t.Errorf("nextID: got %d, want 3", nextID)
+	}
+}
+
+func TestStartOutboxReplaysSlack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	posted := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		posted <- r.Header.Get("Authorization") + " " + r.FormValue("token") + " " + r.FormValue("channel")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true,"channel":"C1","ts":"1.0"}`))
+	}))
+	defer srv.Close()
+	defer func(u string) { slackAPIURL = u }(slackAPIURL)
+	slackAPIURL = srv.URL + "/"
+	defer func(d string) { *outboxDir = d }(*outboxDir)
+	*outboxDir = dir
+
+	conf := []Config{{SlackToken: "xoxb-replay"}}
+	ref := defaultSlackConfig().withEntryToken(conf[0]).tokenRef()
+	// 再起動で消えたtokenのmessageは捨てて、後ろのmessageを止めない
+	items := []outboxItem{
+		{Output: outputSlack, Created: time.Now(), Slack: &slackPost{Channel: "replay", Text: "lost", TokenRef: "token:0000000000000000"}},
+		{Output: outputSlack, Created: time.Now(), Slack: &slackPost{Channel: "replay", Text: "kept", TokenRef: ref}},
+	}
+	var wal []byte
+	for i := range items {
+		b, err := json.Marshal(walRecord{Op: walPut, ID: uint64(i), Item: &items[i]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wal = append(append(wal, b...), '\n')
+	}
+	path := filepath.Join(dir, "slack-replay"+walExt)
+	if err := ioutil.WriteFile(path, wal, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// 前の起動で登録されたtokenは残っていない
+	slackTokensMu.Lock()
+	delete(slackTokens, ref)
+	slackTokensMu.Unlock()
+
+	if err := startOutbox(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		deliveryOutbox.stop()
+		deliveryOutbox = nil
+	}()
+	select {
+	case p := <-posted:
+		if !strings.Contains(p, "xoxb-replay") || !strings.HasSuffix(p, "replay") {
+			t.Errorf("posted with %q", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replayed message was not posted")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, _, err := readWAL(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("messages left in outbox: %+v", pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case p := <-posted:
+		t.Errorf("message with unknown token was posted: %q", p)
+	default:
+	}
+}
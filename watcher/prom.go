@@ -43,16 +43,126 @@ var (
 		},
 		labels,
 	)
+	eventWatcherConfigEntries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ew_config_entries",
+			Help: "Number of config entries by source file.",
+		},
+		[]string{"source"},
+	)
+	eventWatcherNotifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ew_notifications_total",
+			Help: "Number of events notified by source of config entry.",
+		},
+		[]string{"source"},
+	)
+	eventWatcherSilenced = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ew_silenced_total",
+			Help: "Number of events not notified by silences by source of config entry.",
+		},
+		[]string{"source"},
+	)
+	eventWatcherSilences = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "ew_silences_active",
+			Help: "Number of active silences.",
+		},
+		func() float64 { return float64(silences.count()) },
+	)
+	eventWatcherEscalations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ew_escalations_total",
+			Help: "Number of escalated alerts by escalation name.",
+		},
+		[]string{"name"},
+	)
+	eventWatcherRateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ew_rate_limited_total",
+			Help: "Number of messages delayed or suppressed by rate limit by output and destination.",
+		},
+		[]string{"output", "destination", "result"},
+	)
+	eventWatcherDeliveryDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ew_delivery_dropped_total",
+			Help: "Number of messages dropped after retries by output and source of config entry.",
+		},
+		[]string{"output", "source"},
+	)
+	eventWatcherOutboxPending = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ew_outbox_pending",
+			Help: "Number of messages waiting for delivery in the outbox by output and destination.",
+		},
+		[]string{"output", "destination"},
+	)
+	eventWatcherOutboxDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ew_outbox_deliveries_total",
+			Help: "Number of delivery attempts from the outbox by output, destination and result.",
+		},
+		[]string{"output", "destination", "result"},
+	)
+	eventWatcherWatches = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ew_watches",
+			Help: "Number of running event watches.",
+		},
+	)
+	eventWatcherConfigReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ew_config_reload_total",
+			Help: "Number of config reloads by result.",
+		},
+		[]string{"result"},
+	)
+	eventWatcherConfigLastReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ew_config_last_reload_successful",
+			Help: "Whether the last config reload attempt was successful.",
+		},
+	)
+	eventWatcherConfigLastReloadSuccessTime = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ew_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful config reload.",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(eventWatcherEventCount)
+	prometheus.MustRegister(eventWatcherConfigEntries)
+	prometheus.MustRegister(eventWatcherNotifications)
+	prometheus.MustRegister(eventWatcherSilenced)
+	prometheus.MustRegister(eventWatcherSilences)
+	prometheus.MustRegister(eventWatcherEscalations)
+	prometheus.MustRegister(eventWatcherRateLimited)
+	prometheus.MustRegister(eventWatcherDeliveryDropped)
+	prometheus.MustRegister(eventWatcherOutboxPending)
+	prometheus.MustRegister(eventWatcherOutboxDeliveries)
+	prometheus.MustRegister(eventWatcherWatches)
+	prometheus.MustRegister(eventWatcherConfigReloads)
+	prometheus.MustRegister(eventWatcherConfigLastReloadSuccessful)
+	prometheus.MustRegister(eventWatcherConfigLastReloadSuccessTime)
 }
 
 // PromServer :prometheusのメトリクスエンドポイントを起動
 func PromServer() {
+	if *enableSilences {
+		if err := silences.load(*silencesFile); err != nil {
+			panic(err)
+		}
+	}
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
+		if *enableSilences {
+			http.HandleFunc(silencesPath, authorizeSilences(silencesHandler))
+			http.HandleFunc(silencesPath+"/", authorizeSilences(silencesHandler))
+		}
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(rootDoc))
 		})
@@ -74,3 +184,20 @@ func setPromMetrics(e *v1.Event) {
 	}
 	eventWatcherEventCount.With(label).Set(float64(e.Count))
 }
+
+// 起動時の読み込みも成功したreloadとして扱う
+func initReloadMetrics() {
+	eventWatcherConfigLastReloadSuccessful.Set(1)
+	eventWatcherConfigLastReloadSuccessTime.SetToCurrentTime()
+}
+
+func setReloadMetrics(success bool) {
+	if success {
+		eventWatcherConfigReloads.WithLabelValues("success").Inc()
+		eventWatcherConfigLastReloadSuccessful.Set(1)
+		eventWatcherConfigLastReloadSuccessTime.SetToCurrentTime()
+		return
+	}
+	eventWatcherConfigReloads.WithLabelValues("failure").Inc()
+	eventWatcherConfigLastReloadSuccessful.Set(0)
+}
@@ -0,0 +1,133 @@
+package watcher
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultSlackRateLimit   = 1.0
+	defaultSlackRateBurst   = 3
+	defaultCWLogsRateLimit  = 5.0
+	defaultCWLogsRateBurst  = 5
+	defaultRateLimitMaxWait = 3 * time.Second
+	// rateLimitSummaryDelay は送れなかった数をまとめて送るまでの時間
+	rateLimitSummaryDelay = 10 * time.Second
+)
+
+var (
+	slackRateLimit   = flag.Float64("slackRateLimit", defaultSlackRateLimit, "Messages per second to each Slack channel. 0 disables rate limiting.")
+	slackRateBurst   = flag.Int("slackRateBurst", defaultSlackRateBurst, "Burst of messages to each Slack channel.")
+	cwlogsRateLimit  = flag.Float64("cwlogsRateLimit", defaultCWLogsRateLimit, "Requests per second to each Cloudwatch logs stream. 0 disables rate limiting.")
+	cwlogsRateBurst  = flag.Int("cwlogsRateBurst", defaultCWLogsRateBurst, "Burst of requests to each Cloudwatch logs stream.")
+	rateLimitMaxWait = flag.Duration("rateLimitMaxWait", defaultRateLimitMaxWait, "How long to wait for rate limit before suppressing a message. Suppressed messages are sent as a summary later.")
+)
+
+// destLimiter は送信先ごとのtoken bucket。待ちきれないものは数だけ数えて後でまとめて送る
+type destLimiter struct {
+	output      string
+	destination string
+	limiter     *rate.Limiter
+	mu          sync.Mutex
+	suppressed  int
+	// summary は送れなかった数を送る関数。最後に送ろうとした設定で送る
+	summary func(n int)
+	timer   *time.Timer
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*destLimiter{}
+)
+
+// limiterFor は出力先と送信先ごとのlimiter。rateが0以下なら制限しない
+func limiterFor(output string, destination string, r float64, burst int) *destLimiter {
+	key := output + "/" + destination
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l, ok := limiters[key]
+	if !ok {
+		limit := rate.Limit(r)
+		if r <= 0 {
+			limit = rate.Inf
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		l = &destLimiter{
+			output:      output,
+			destination: destination,
+			limiter:     rate.NewLimiter(limit, burst),
+		}
+		limiters[key] = l
+	}
+	return l
+}
+
+// allow は-rateLimitMaxWaitまで待てば送れるならその分待ってtrue、そうでなければ送らずにfalseを返す
+// falseの場合、送れなかった数はsummaryで後から送る
+func (l *destLimiter) allow(summary func(n int)) bool {
+	r := l.limiter.Reserve()
+	d := r.Delay()
+	if d <= *rateLimitMaxWait {
+		if d > 0 {
+			eventWatcherRateLimited.WithLabelValues(l.output, l.destination, "delayed").Inc()
+			time.Sleep(d)
+		}
+		return true
+	}
+	r.Cancel()
+	eventWatcherRateLimited.WithLabelValues(l.output, l.destination, "suppressed").Inc()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.suppressed++
+	l.summary = summary
+	if l.timer == nil {
+		l.timer = time.AfterFunc(rateLimitSummaryDelay, l.flush)
+	}
+	return false
+}
+
+// wait はtokenを待つ。outboxからはmessageを捨てずに送るので、allowの代わりに使う
+func (l *destLimiter) wait(ctx context.Context) error {
+	r := l.limiter.Reserve()
+	d := r.Delay()
+	if d == 0 {
+		return nil
+	}
+	eventWatcherRateLimited.WithLabelValues(l.output, l.destination, "delayed").Inc()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
+
+// flush は送れなかった数をtokenを待ってから送る
+func (l *destLimiter) flush() {
+	if err := l.limiter.Wait(context.Background()); err != nil {
+		glog.Errorf("Error wait rate limit of %s %s : %s\n", l.output, l.destination, err)
+	}
+	l.mu.Lock()
+	n, summary := l.suppressed, l.summary
+	l.suppressed = 0
+	l.timer = nil
+	l.mu.Unlock()
+	if n > 0 && summary != nil {
+		summary(n)
+	}
+}
+
+func rateLimitMessage(n int, output string, destination string) string {
+	return fmt.Sprintf("%d events suppressed by rate limit of %s %s", n, output, destination)
+}
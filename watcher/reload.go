@@ -0,0 +1,409 @@
+package watcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+	v1 "k8s.io/api/core/v1"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// ConfigMapの更新はsymlinkの張り替えで複数のfile eventになるのでまとめる
+	reloadDebounce = time.Second
+	// 後継のcontrollerのcache syncを待つ上限
+	handoverTimeout = time.Minute
+	// 終了時にcontrollerがqueueに残っているeventを送り終えるのを待つ上限
+	stopTimeout = 30 * time.Second
+	// Namespaceの変更をまとめて反映する
+	namespaceSyncDelay = time.Second
+)
+
+type runningWatch struct {
+	conf       Config
+	controller *controller
+	stop       chan struct{}
+}
+
+// watchManager は設定entryごとのcontrollerを管理する
+// 設定fileとEventWatcherRuleの両方の設定をまとめて差分を反映する
+type watchManager struct {
+	client     kubernetes.Interface
+	namespaces *namespaceCache
+	mu         sync.Mutex
+	running    map[string]*runningWatch
+	started    bool
+	file       []Config
+	rules      map[string]Config
+	templates  string
+	// namespaceの変更によるsyncを待っている
+	nsSyncPending bool
+	stopped       bool
+}
+
+func newWatchManager(client kubernetes.Interface, namespaces *namespaceCache) *watchManager {
+	m := &watchManager{
+		client:     client,
+		namespaces: namespaces,
+		running:    map[string]*runningWatch{},
+		rules:      map[string]Config{},
+	}
+	namespaces.onChange(m.namespaceChanged)
+	return m
+}
+
+// namespaceChanged はNamespaceが変わった時にnamespaceSelectorのentryを反映する
+// 起動時のlistなどでまとめて来るので少し待ってからsyncする
+func (m *watchManager) namespaceChanged() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.nsSyncPending {
+		return
+	}
+	m.nsSyncPending = true
+	time.AfterFunc(namespaceSyncDelay, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.nsSyncPending = false
+		added, removed := m.sync()
+		if added > 0 || removed > 0 {
+			glog.Infof("namespaces changed: %d watches started, %d watches stopped\n", added, removed)
+		}
+	})
+}
+
+// entryKey は設定entryの内容から作るcheckpointのkey。fileの中の位置やtemplateが変わっても変わらない
+func entryKey(cf Config, n int) string {
+	return watchKey(cf, "", n)
+}
+
+// watchKey は設定entryとtemplateの内容から作るcontrollerの識別子。同じ内容のentryはn番目で区別する
+func watchKey(cf Config, templates string, n int) string {
+	b, err := yaml.Marshal(cf)
+	if err != nil {
+		b = []byte(fmt.Sprintf("%#v", cf))
+	}
+	h := sha256.Sum256(append(b, templates...))
+	return fmt.Sprintf("%s#%d", hex.EncodeToString(h[:8]), n)
+}
+
+// setFileConfig は設定fileの内容を差し替える
+func (m *watchManager) setFileConfig(conf []Config, templates string) (added int, removed int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.file = conf
+	m.templates = templates
+	return m.sync()
+}
+
+// setRule はEventWatcherRuleの設定を差し替える。nilなら削除
+func (m *watchManager) setRule(key string, cf *Config) (added int, removed int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cf == nil {
+		delete(m.rules, key)
+	} else {
+		m.rules[key] = *cf
+	}
+	return m.sync()
+}
+
+func (m *watchManager) desired() []Config {
+	conf := append([]Config{}, m.file...)
+	keys := make([]string, 0, len(m.rules))
+	for k := range m.rules {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		conf = append(conf, m.rules[k])
+	}
+	var expanded []Config
+	for _, cf := range conf {
+		expanded = append(expanded, m.expandNamespaces(cf)...)
+	}
+	return expanded
+}
+
+// expandNamespaces はnamespacesとnamespaceSelectorのentryをnamespaceごとのentryに分ける
+func (m *watchManager) expandNamespaces(cf Config) []Config {
+	if !cf.multiNamespace() {
+		return []Config{cf}
+	}
+	set := map[string]bool{}
+	for _, ns := range cf.Namespaces {
+		set[ns] = true
+	}
+	if cf.NamespaceSelector != "" {
+		selector, err := k8slabels.Parse(cf.NamespaceSelector)
+		if err != nil {
+			glog.Errorf("%s: invalid namespaceSelector : %s\n", cf.name(), err)
+		} else {
+			for _, ns := range m.namespaces.matching(selector) {
+				set[ns] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(set))
+	for ns := range set {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	var expanded []Config
+	for _, ns := range names {
+		c := cf
+		c.Namespace = ns
+		c.Namespaces = nil
+		c.NamespaceSelector = ""
+		expanded = append(expanded, c)
+	}
+	return expanded
+}
+
+// sync は設定の差分だけcontrollerを起動・停止する。m.muをとって呼ぶ
+func (m *watchManager) sync() (added int, removed int) {
+	if m.stopped {
+		return 0, 0
+	}
+	desired := map[string]Config{}
+	entries := map[string]string{}
+	seen := map[string]int{}
+	for _, cf := range m.desired() {
+		templates := m.templates + fingerprintFiles(cf.templateFiles())
+		base := watchKey(cf, templates, 0)
+		key := watchKey(cf, templates, seen[base])
+		desired[key] = cf
+		entries[key] = entryKey(cf, seen[base])
+		seen[base]++
+	}
+
+	// 起動中のcontrollerとの境界。これ以降に発生したeventは新しいcontrollerが送る
+	// lastTimestampは秒単位なので秒に切り捨てる。同じ秒のeventはどちらも新しいcontrollerが送る
+	cutoff := time.Now().Local().Truncate(time.Second)
+	var newWatches []*runningWatch
+	for key, cf := range desired {
+		if _, ok := m.running[key]; ok {
+			continue
+		}
+		rw := &runningWatch{
+			conf:       cf,
+			controller: newWatch(m.client, m.namespaces, cf, entries[key], cutoff, m.started),
+			stop:       make(chan struct{}),
+		}
+		go rw.controller.run(rw.stop)
+		m.running[key] = rw
+		newWatches = append(newWatches, rw)
+	}
+
+	var oldWatches []*runningWatch
+	for key, rw := range m.running {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		oldWatches = append(oldWatches, rw)
+		delete(m.running, key)
+	}
+	m.started = true
+	eventWatcherWatches.Set(float64(len(m.running)))
+
+	if len(oldWatches) > 0 {
+		// cutoff以降のeventは新しいcontrollerが最初のlistから送るので、古いcontrollerはすぐに送るのをやめる
+		for _, rw := range oldWatches {
+			rw.controller.setEndTime(cutoff)
+		}
+		go handover(newWatches, oldWatches)
+	}
+	return len(newWatches), len(oldWatches)
+}
+
+// handover は新しいcontrollerのcache syncを待ってから古いcontrollerを止める
+// cutoff以前のeventは古いcontroller、以降は新しいcontrollerが送るので欠落も重複もしない
+// 古いcontrollerのendTimeはsyncで設定済みで、ここではcutoff以前のeventのupdateを送り終えるのを待つだけ
+func handover(newWatches []*runningWatch, oldWatches []*runningWatch) {
+	var synced []cache.InformerSynced
+	for _, rw := range newWatches {
+		synced = append(synced, rw.controller.informer.HasSynced)
+	}
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(handoverTimeout, func() { close(timeout) })
+	defer timer.Stop()
+	if !cache.WaitForCacheSync(timeout, synced...) {
+		glog.Warningf("timed out waiting for new watches to sync, stop old watches anyway")
+	}
+	for _, rw := range oldWatches {
+		close(rw.stop)
+	}
+	for _, rw := range oldWatches {
+		<-rw.controller.done
+	}
+	glog.Infof("stopped %d old watches", len(oldWatches))
+}
+
+// watchedFiles は変更を監視するfile。entryごとのtemplate fileも含む
+func (m *watchManager) watchedFiles() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// directoryやglobならfileが増えたことに気づけるようにそのものも入れる
+	files := []string{configPath()}
+	if cfs, err := configFiles(); err == nil {
+		files = append(files, cfs...)
+	}
+	files = append(files, templateFiles()...)
+	for _, cf := range m.desired() {
+		files = append(files, cf.templateFiles()...)
+	}
+	return files
+}
+
+// stopAll は全てのcontrollerを止めて、queueに残っているeventを送り終えるのをstopTimeoutまで待つ
+func (m *watchManager) stopAll() {
+	m.mu.Lock()
+	m.stopped = true
+	var stopping []*runningWatch
+	for key, rw := range m.running {
+		close(rw.stop)
+		delete(m.running, key)
+		stopping = append(stopping, rw)
+	}
+	eventWatcherWatches.Set(0)
+	m.mu.Unlock()
+
+	timeout := time.After(stopTimeout)
+	for _, rw := range stopping {
+		select {
+		case <-rw.controller.done:
+		case <-timeout:
+			glog.Warningf("timed out waiting for watches to stop")
+			return
+		}
+	}
+}
+
+// reload は設定とtemplateを読み直して、検証に通れば差分を反映する
+func (m *watchManager) reload() {
+	conf, err := LoadConfig()
+	if err != nil {
+		glog.Errorf("config reload failed, keep current config : %s\n", err)
+		setReloadMetrics(false)
+		return
+	}
+	if err := validateTemplates(); err != nil {
+		glog.Errorf("config reload failed, keep current config : %s\n", err)
+		setReloadMetrics(false)
+		return
+	}
+	added, removed := m.setFileConfig(conf, fingerprintTemplates())
+	glog.Infof("config reloaded: %d watches started, %d watches stopped\n", added, removed)
+	setReloadMetrics(true)
+}
+
+func templateFiles() []string {
+	var files []string
+	for _, f := range []string{*slackTemplateFile, *cwlogsTemplateFile, *stdoutTemplateFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// fingerprintTemplates はtemplate fileの内容のhash。templateが変わったら全controllerを作り直す
+func fingerprintTemplates() string {
+	return fingerprintFiles(templateFiles())
+}
+
+func fingerprintFiles(files []string) string {
+	h := sha256.New()
+	for _, f := range files {
+		h.Write([]byte(f))
+		if b, err := ioutil.ReadFile(f); err == nil {
+			h.Write(b)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func validateTemplates() error {
+	if *slackTemplateFile != "" {
+		if _, err := parseTemplateFile(*slackTemplateFile, slackTplFuncs, v1.Event{}); err != nil {
+			return err
+		}
+	}
+	if *cwlogsTemplateFile != "" {
+		if _, err := parseTemplateFile(*cwlogsTemplateFile, tplFuncs, evPlusAct{}); err != nil {
+			return err
+		}
+	}
+	if *stdoutTemplateFile != "" && *stdoutFormat == stdoutFormatTemplate {
+		if _, err := parseTemplateFile(*stdoutTemplateFile, tplFuncs, v1.Event{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchConfigFiles は設定fileとtemplate fileを監視して、内容が変わったらreloadChに通知する
+func watchConfigFiles(watchedFiles func() []string, reloadCh chan<- struct{}, stopCh <-chan struct{}) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		glog.Errorf("error create file watcher, hot reload by file change is disabled : %s\n", err)
+		return
+	}
+	defer w.Close()
+
+	// ConfigMapはsymlinkの張り替えで更新されるのでdirectoryごと監視する
+	dirs := map[string]bool{}
+	watchDirs := func(files []string) {
+		for _, f := range files {
+			d := filepath.Dir(f)
+			if dirs[d] {
+				continue
+			}
+			if err := w.Add(d); err != nil {
+				glog.Errorf("error watch directory %v : %s\n", d, err)
+				continue
+			}
+			dirs[d] = true
+		}
+	}
+
+	files := watchedFiles()
+	watchDirs(files)
+	last := fingerprintFiles(files)
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-w.Events:
+			debounce = time.After(reloadDebounce)
+		case err := <-w.Errors:
+			glog.Errorf("error file watcher : %s\n", err)
+		case <-debounce:
+			// reloadでentryのtemplate fileが増えているかもしれない
+			files = watchedFiles()
+			watchDirs(files)
+			fp := fingerprintFiles(files)
+			if fp == last {
+				continue
+			}
+			last = fp
+			glog.Infoln("config or template file changed, reload config")
+			select {
+			case reloadCh <- struct{}{}:
+			default:
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	defaultWatchRules = false
+)
+
+var (
+	watchRules = flag.Bool("watchRules", defaultWatchRules, "Whether to load config from EventWatcherRule custom resources.")
+)
+
+var ruleGVR = schema.GroupVersionResource{
+	Group:    "kube-event-watcher.buildsville.github.io",
+	Version:  "v1alpha1",
+	Resource: "eventwatcherrules",
+}
+
+// EventWatcherRuleのspec。Configからnamespaceを除いたもので、namespaceはruleを置いたnamespaceになる
+type ruleSpec struct {
+	WatchEvent     watchEvent      `yaml:"watchEvent"`
+	FieldSelectors []fieldSelector `yaml:"fieldSelectors"`
+	ExtraFilter    extraFilter     `yaml:"extraFilter"`
+	Routing        ruleRouting     `yaml:"routing"`
+}
+
+// template fileはwatcherのpodにあるものなのでruleではinlineだけ指定できる
+type ruleRouting struct {
+	Channel        string   `yaml:"channel"`
+	LogStream      string   `yaml:"logStream"`
+	SlackTemplate  string   `yaml:"slackTemplate"`
+	CWLogsTemplate string   `yaml:"cwlogsTemplate"`
+	Outputs        []string `yaml:"outputs"`
+}
+
+func (s ruleSpec) toConfig(namespace string) Config {
+	return Config{
+		Namespace:      namespace,
+		WatchEvent:     s.WatchEvent,
+		FieldSelectors: s.FieldSelectors,
+		ExtraFilter:    s.ExtraFilter,
+		Channel:        s.Routing.Channel,
+		LogStream:      s.Routing.LogStream,
+		SlackTemplate:  s.Routing.SlackTemplate,
+		CWLogsTemplate: s.Routing.CWLogsTemplate,
+		Outputs:        s.Routing.Outputs,
+	}
+}
+
+type ruleController struct {
+	client   dynamic.Interface
+	informer cache.SharedIndexInformer
+	manager  *watchManager
+}
+
+func dynamicClient(config *rest.Config) dynamic.Interface {
+	ret, err := dynamic.NewForConfig(config)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+func newRuleController(client dynamic.Interface, manager *watchManager) *ruleController {
+	rc := &ruleController{
+		client:   client,
+		informer: dynamicinformer.NewFilteredDynamicInformer(client, ruleGVR, metav1.NamespaceAll, 0, cache.Indexers{}, nil).Informer(),
+		manager:  manager,
+	}
+	rc.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			rc.handleRule(obj)
+		},
+		UpdateFunc: func(old, new interface{}) {
+			o, ok1 := old.(*unstructured.Unstructured)
+			n, ok2 := new.(*unstructured.Unstructured)
+			// statusの更新だけならspecは変わっていない
+			if ok1 && ok2 && o.GetGeneration() == n.GetGeneration() {
+				return
+			}
+			rc.handleRule(new)
+		},
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err != nil {
+				return
+			}
+			added, removed := rc.manager.setRule(key, nil)
+			glog.Infof("EventWatcherRule %s deleted: %d watches started, %d watches stopped\n", key, added, removed)
+		},
+	})
+	return rc
+}
+
+func (rc *ruleController) run(stopCh <-chan struct{}) {
+	defer runtime.HandleCrash()
+	glog.Infoln("Starting EventWatcherRule controller")
+	rc.informer.Run(stopCh)
+	glog.Infoln("Stopping EventWatcherRule controller")
+}
+
+func (rc *ruleController) handleRule(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		glog.Warningf("object is not *unstructured.Unstructured : %T", obj)
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(u)
+	if err != nil {
+		return
+	}
+	cf, err := parseRule(u)
+	if err != nil {
+		glog.Errorf("EventWatcherRule %s is invalid : %s\n", key, err)
+		// 不正なruleは止めておく
+		rc.manager.setRule(key, nil)
+		rc.updateStatus(u, "False", "InvalidSpec", err.Error())
+		return
+	}
+	added, removed := rc.manager.setRule(key, &cf)
+	glog.Infof("EventWatcherRule %s loaded: %d watches started, %d watches stopped\n", key, added, removed)
+	rc.updateStatus(u, "True", "Watching", "events are watched")
+}
+
+func parseRule(u *unstructured.Unstructured) (Config, error) {
+	spec, ok := u.Object["spec"]
+	if !ok {
+		return Config{}, fmt.Errorf("spec is not set")
+	}
+	// yamlはjsonのsupersetなので設定fileと同じく厳密にdecodeする
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return Config{}, err
+	}
+	var s ruleSpec
+	if err := yaml.UnmarshalStrict(b, &s); err != nil {
+		return Config{}, err
+	}
+	cf := s.toConfig(u.GetNamespace())
+	cf.Source = fmt.Sprintf("EventWatcherRule %s/%s", u.GetNamespace(), u.GetName())
+	if errs := validateEntry(cf); len(errs) > 0 {
+		return Config{}, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return cf, nil
+}
+
+func (rc *ruleController) updateStatus(u *unstructured.Unstructured, status string, reason string, message string) {
+	obj := u.DeepCopy()
+	now := time.Now().UTC().Format(time.RFC3339)
+	cond := map[string]interface{}{
+		"type":               "Ready",
+		"status":             status,
+		"reason":             reason,
+		"message":            message,
+		"lastTransitionTime": now,
+	}
+	// statusが変わらないならlastTransitionTimeは据え置く
+	if conds, found, _ := unstructured.NestedSlice(obj.Object, "status", "conditions"); found {
+		for _, c := range conds {
+			old, ok := c.(map[string]interface{})
+			if !ok || old["type"] != "Ready" {
+				continue
+			}
+			if old["status"] == status && old["reason"] == reason && old["message"] == message &&
+				obj.GetGeneration() == statusObservedGeneration(obj) {
+				return
+			}
+			if old["status"] == status {
+				cond["lastTransitionTime"] = old["lastTransitionTime"]
+			}
+		}
+	}
+	if err := unstructured.SetNestedSlice(obj.Object, []interface{}{cond}, "status", "conditions"); err != nil {
+		glog.Errorf("error set status of EventWatcherRule %s/%s : %s\n", obj.GetNamespace(), obj.GetName(), err)
+		return
+	}
+	if err := unstructured.SetNestedField(obj.Object, obj.GetGeneration(), "status", "observedGeneration"); err != nil {
+		glog.Errorf("error set status of EventWatcherRule %s/%s : %s\n", obj.GetNamespace(), obj.GetName(), err)
+		return
+	}
+	_, err := rc.client.Resource(ruleGVR).Namespace(obj.GetNamespace()).UpdateStatus(context.TODO(), obj, metav1.UpdateOptions{})
+	if err != nil {
+		glog.Errorf("error update status of EventWatcherRule %s/%s : %s\n", obj.GetNamespace(), obj.GetName(), err)
+	}
+}
+
+func statusObservedGeneration(u *unstructured.Unstructured) int64 {
+	g, _, _ := unstructured.NestedInt64(u.Object, "status", "observedGeneration")
+	return g
+}
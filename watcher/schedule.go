@@ -0,0 +1,183 @@
+package watcher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	// containerのimageにtimezoneのdataがなくてもwindowのtimezoneを使えるようにする
+	_ "time/tzdata"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// schedulesのaction
+const (
+	scheduleSuppress = "suppress"
+	scheduleLogOnly  = "logOnly"
+)
+
+// schedule は定期的なmaintenanceやquiet hoursの時間帯。matchにmatchするeventを止めるかlogだけにする
+// windowは`<days> HH:MM-HH:MM [timezone]`。e.g. `weekdays 02:00-04:00 Asia/Tokyo`
+type schedule struct {
+	Window string      `yaml:"window"`
+	Action string      `yaml:"action"`
+	Match  *filterNode `yaml:"match"`
+}
+
+// window はparseしたschedule.Window。endがstartより前なら日をまたぐ
+type window struct {
+	days       [7]bool
+	start, end int
+	loc        *time.Location
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseWindow(s string) (window, error) {
+	w := window{loc: time.Local}
+	fields := strings.Fields(strings.Replace(s, "–", "-", -1))
+	if len(fields) != 2 && len(fields) != 3 {
+		return w, fmt.Errorf("must be `<days> HH:MM-HH:MM [timezone]`, got %q", s)
+	}
+	if err := w.parseDays(strings.ToLower(fields[0])); err != nil {
+		return w, err
+	}
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return w, fmt.Errorf("time range must be HH:MM-HH:MM, got %q", fields[1])
+	}
+	var err error
+	if w.start, err = parseClock(times[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(times[1]); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("time range is empty, got %q", fields[1])
+	}
+	if len(fields) == 3 {
+		if w.loc, err = time.LoadLocation(fields[2]); err != nil {
+			return w, err
+		}
+	}
+	return w, nil
+}
+
+// parseDays はdaily、weekdays、weekends、`mon-fri`、`sat,sun`のような指定
+func (w *window) parseDays(s string) error {
+	switch s {
+	case "daily":
+		s = "sun-sat"
+	case "weekdays":
+		s = "mon-fri"
+	case "weekends":
+		s = "sat,sun"
+	}
+	for _, d := range strings.Split(s, ",") {
+		r := strings.Split(d, "-")
+		from, ok := weekdayNames[r[0]]
+		if !ok {
+			return fmt.Errorf("unknown day %q", r[0])
+		}
+		to := from
+		if len(r) == 2 {
+			if to, ok = weekdayNames[r[1]]; !ok {
+				return fmt.Errorf("unknown day %q", r[1])
+			}
+		} else if len(r) > 2 {
+			return fmt.Errorf("invalid days %q", d)
+		}
+		for i := from; ; i = (i + 1) % 7 {
+			w.days[i] = true
+			if i == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock はHH:MMを0時からの分にする。24:00も使える
+func parseClock(s string) (int, error) {
+	hm := strings.Split(s, ":")
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("time must be HH:MM, got %q", s)
+	}
+	h, err1 := strconv.Atoi(hm[0])
+	m, err2 := strconv.Atoi(hm[1])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("time must be HH:MM, got %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// contains はtが時間帯に含まれるかどうか。日をまたぐ場合は開始した日の曜日で判定する
+func (w window) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	m := t.Hour()*60 + t.Minute()
+	wd := t.Weekday()
+	if w.start < w.end {
+		return w.days[wd] && w.start <= m && m < w.end
+	}
+	return (w.days[wd] && m >= w.start) || (w.days[(wd+6)%7] && m < w.end)
+}
+
+func validateSchedule(s schedule) []string {
+	var errs []string
+	if _, err := parseWindow(s.Window); err != nil {
+		errs = append(errs, fmt.Sprintf("window: %s", err))
+	}
+	switch s.Action {
+	case scheduleSuppress, scheduleLogOnly:
+	default:
+		errs = append(errs, fmt.Sprintf("action: must be %s or %s, got %q", scheduleSuppress, scheduleLogOnly, s.Action))
+	}
+	if s.Match != nil {
+		errs = append(errs, validateFilterNode("match", *s.Match)...)
+	}
+	return errs
+}
+
+// activeSchedule はwindowをparseしたschedule
+type activeSchedule struct {
+	schedule
+	window window
+}
+
+func compileSchedules(ss []schedule) []activeSchedule {
+	var compiled []activeSchedule
+	for _, s := range ss {
+		w, err := parseWindow(s.Window)
+		if err != nil {
+			// validateConfigで弾いているのでここには来ない
+			continue
+		}
+		compiled = append(compiled, activeSchedule{schedule: s, window: w})
+	}
+	return compiled
+}
+
+// scheduleAction はscheduleの時間帯とmatchで、eventに適用するactionを返す。なければ""
+// 最初にmatchしたscheduleを使う
+func scheduleAction(ss []activeSchedule, event *v1.Event, now time.Time) string {
+	for _, s := range ss {
+		if !s.window.contains(now) {
+			continue
+		}
+		if s.Match != nil && !s.Match.eval(event) {
+			continue
+		}
+		return s.Action
+	}
+	return ""
+}
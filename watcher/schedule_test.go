@@ -0,0 +1,74 @@
+package watcher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		window  string
+		wantErr bool
+	}{
+		{"weekdays 02:00-04:00", false},
+		{"daily 22:00-06:00 Asia/Tokyo", false},
+		{"sat,sun 00:00-24:00", false},
+		{"fri-mon 18:00–09:00 UTC", false},
+		{"mon 09:00-09:00", true},
+		{"someday 02:00-04:00", true},
+		{"mon-tue-wed 02:00-04:00", true},
+		{"mon 2:00", true},
+		{"mon 02:00-24:01", true},
+		{"mon 02:60-04:00", true},
+		{"mon 02:00-04:00 Nowhere/City", true},
+		{"mon", true},
+	}
+	for _, tt := range tests {
+		_, err := parseWindow(tt.window)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want error %v", tt.window, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2024-01-01は月曜日
+	at := func(day int, hour int, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, tokyo)
+	}
+	tests := []struct {
+		window string
+		t      time.Time
+		want   bool
+	}{
+		{"weekdays 02:00-04:00 Asia/Tokyo", at(1, 2, 0), true},
+		{"weekdays 02:00-04:00 Asia/Tokyo", at(1, 3, 59), true},
+		{"weekdays 02:00-04:00 Asia/Tokyo", at(1, 4, 0), false},
+		{"weekdays 02:00-04:00 Asia/Tokyo", at(1, 1, 59), false},
+		{"weekdays 02:00-04:00 Asia/Tokyo", at(6, 3, 0), false},
+		// 日をまたぐwindowは開始した日の曜日で判定する
+		{"fri 22:00-06:00 Asia/Tokyo", at(5, 23, 0), true},
+		{"fri 22:00-06:00 Asia/Tokyo", at(6, 5, 59), true},
+		{"fri 22:00-06:00 Asia/Tokyo", at(6, 6, 0), false},
+		{"fri 22:00-06:00 Asia/Tokyo", at(5, 5, 0), false},
+		{"fri 22:00-06:00 Asia/Tokyo", at(6, 23, 0), false},
+		{"sun 00:00-24:00 Asia/Tokyo", at(7, 23, 59), true},
+		{"sun 00:00-24:00 Asia/Tokyo", at(8, 0, 0), false},
+		// windowのtimezoneで判定する
+		{"mon 09:00-10:00 UTC", at(1, 18, 30), true},
+		{"mon 09:00-10:00 UTC", at(1, 9, 30), false},
+	}
+	for _, tt := range tests {
+		w, err := parseWindow(tt.window)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.window, err)
+		}
+		if got := w.contains(tt.t); got != tt.want {
+			t.Errorf("%q contains %s: got %v, want %v", tt.window, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
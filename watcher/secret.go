@@ -0,0 +1,136 @@
+package watcher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ${VAR} の形式だけ展開する。$VAR は正規表現の`$`とぶつかるので展開しない。`$${VAR}`はそのまま残す
+var envVarPattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// validateOnly はvalidate commandの時にtrue。環境変数とsecret fileは実行する環境にしかないので、書き方だけ確かめる
+var validateOnly bool
+
+// expandEnv は文字列の中の ${VAR} を環境変数の値に置き換える。未定義の変数は置き換えずに名前を返す
+func expandEnv(s string) (string, []string) {
+	var missing []string
+	out := envVarPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if strings.HasPrefix(m, "$$") {
+			return m[1:]
+		}
+		name := envVarPattern.FindStringSubmatch(m)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+			return m
+		}
+		return v
+	})
+	return out, missing
+}
+
+// expandEnvFields はdecodeした後の設定のstring fieldだけを展開する。値に`: `や`#`や改行があってもyamlの構造は変わらない
+// 未定義の変数はfieldのyamlのpathと一緒に返す
+func expandEnvFields(v reflect.Value, path string) []string {
+	var errs []string
+	switch v.Kind() {
+	case reflect.String:
+		s, missing := expandEnv(v.String())
+		if len(missing) > 0 {
+			errs = append(errs, fmt.Sprintf("%s: environment variable is not set: %s", path, strings.Join(missing, ", ")))
+		}
+		v.SetString(s)
+	case reflect.Ptr:
+		if !v.IsNil() {
+			errs = append(errs, expandEnvFields(v.Elem(), path)...)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			errs = append(errs, expandEnvFields(v.Index(i), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+				continue
+			}
+			// inlineのfieldは親と同じpath
+			p := path
+			if !f.Anonymous {
+				if tag == "" {
+					tag = strings.ToLower(f.Name)
+				}
+				p = joinPath(path, tag)
+			}
+			errs = append(errs, expandEnvFields(v.Field(i), p)...)
+		}
+	}
+	return errs
+}
+
+func joinPath(path string, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// secretFile はmountされたSecretのfile。更新されたら読み直す
+type secretFile struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+var (
+	secretFilesMu sync.Mutex
+	secretFiles   = map[string]*secretFile{}
+)
+
+// loadSecretFile は同じpathなら同じsecretFileを返す
+func loadSecretFile(path string) *secretFile {
+	secretFilesMu.Lock()
+	defer secretFilesMu.Unlock()
+	if s, ok := secretFiles[path]; ok {
+		return s
+	}
+	s := &secretFile{path: path}
+	secretFiles[path] = s
+	return s
+}
+
+// read はfileが変わっていれば読み直して、末尾の改行を除いた中身を返す
+func (s *secretFile) read() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, err := os.Stat(s.path)
+	if err != nil {
+		return s.value, err
+	}
+	if o.ModTime().Equal(s.modTime) && o.Size() == s.size && s.value != "" {
+		return s.value, nil
+	}
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return s.value, err
+	}
+	if s.value != "" {
+		glog.Infof("secret file %v changed, reloaded", s.path)
+	}
+	s.modTime = o.ModTime()
+	s.size = o.Size()
+	s.value = strings.TrimRight(string(b), "\r\n")
+	return s.value, nil
+}
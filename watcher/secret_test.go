@@ -0,0 +1,56 @@
+package watcher
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("EW_TEST_TOKEN", "xoxb-1")
+	os.Setenv("EW_TEST_YAML", "a: b # c\nd")
+	os.Unsetenv("EW_TEST_UNSET")
+	tests := []struct {
+		in          string
+		want        string
+		wantMissing []string
+	}{
+		{"${EW_TEST_TOKEN}", "xoxb-1", nil},
+		{"token-${EW_TEST_TOKEN}-${EW_TEST_TOKEN}", "token-xoxb-1-xoxb-1", nil},
+		{"${EW_TEST_YAML}", "a: b # c\nd", nil},
+		{"$${EW_TEST_TOKEN}", "${EW_TEST_TOKEN}", nil},
+		{"$EW_TEST_TOKEN", "$EW_TEST_TOKEN", nil},
+		{"^foo$", "^foo$", nil},
+		{"${EW_TEST_UNSET}", "${EW_TEST_UNSET}", []string{"EW_TEST_UNSET"}},
+		{"${1INVALID}", "${1INVALID}", nil},
+	}
+	for _, tt := range tests {
+		got, missing := expandEnv(tt.in)
+		if got != tt.want || !reflect.DeepEqual(missing, tt.wantMissing) {
+			t.Errorf("%q: got %q %v, want %q %v", tt.in, got, missing, tt.want, tt.wantMissing)
+		}
+	}
+}
+
+func TestExpandEnvFields(t *testing.T) {
+	os.Setenv("EW_TEST_TOKEN", "xoxb-1")
+	os.Setenv("EW_TEST_YAML", "a: b # c\nd")
+	os.Unsetenv("EW_TEST_UNSET")
+	cf := Config{
+		SlackToken: "${EW_TEST_TOKEN}",
+		Channel:    "${EW_TEST_YAML}",
+		ExtraFilter: extraFilter{
+			Type:    "keep",
+			Filters: []filter{{Key: "Reason", Value: "${EW_TEST_UNSET}"}},
+			Match:   &filterNode{Not: &filterNode{filter: filter{Key: "Reason", Value: "${EW_TEST_TOKEN}"}}},
+		},
+	}
+	errs := expandEnvFields(reflect.ValueOf(&cf).Elem(), "")
+	want := []string{"extraFilter.filters[0].value: environment variable is not set: EW_TEST_UNSET"}
+	if !reflect.DeepEqual(errs, want) {
+		t.Errorf("errors: got %v, want %v", errs, want)
+	}
+	if cf.SlackToken != "xoxb-1" || cf.Channel != "a: b # c\nd" || cf.ExtraFilter.Match.Not.Value != "xoxb-1" {
+		t.Errorf("not expanded: %+v", cf)
+	}
+}
@@ -0,0 +1,379 @@
+package watcher
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultSilences          = false
+	defaultSilencesFile      = ""
+	defaultSilencesTokenFile = ""
+	silencesPath             = "/api/v1/silences"
+)
+
+var (
+	enableSilences    = flag.Bool("silences", defaultSilences, "Whether to enable silences API on the metrics HTTP server.")
+	silencesFile      = flag.String("silencesFile", defaultSilencesFile, "Path of file to persist silences. If not set, silences are lost on restart.")
+	silencesTokenFile = flag.String("silencesTokenFile", defaultSilencesTokenFile, "Path of file of the bearer token required by silences API, e.g. a mounted Secret. If not set, the API has no authentication.")
+)
+
+// silence は一時的に通知を止める条件。matcherは全部matchした時に止める
+// matcherの値は完全一致か`/regex/`で、空なら何にでもmatchする
+type silence struct {
+	ID        string          `json:"id"`
+	Matchers  silenceMatchers `json:"matchers"`
+	StartsAt  time.Time       `json:"startsAt"`
+	EndsAt    time.Time       `json:"endsAt"`
+	CreatedBy string          `json:"createdBy,omitempty"`
+	Comment   string          `json:"comment"`
+}
+
+type silenceMatchers struct {
+	Namespace string `json:"namespace,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Type      string `json:"type,omitempty"`
+}
+
+func (m silenceMatchers) pairs() [][2]string {
+	return [][2]string{
+		{"namespace", m.Namespace},
+		{"kind", m.Kind},
+		{"name", m.Name},
+		{"reason", m.Reason},
+		{"type", m.Type},
+	}
+}
+
+func (s silence) active(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+func (s silence) validate() error {
+	empty := true
+	for _, p := range s.Matchers.pairs() {
+		if p[1] == "" {
+			continue
+		}
+		empty = false
+		if ptn, ok := regexPattern(p[1]); ok {
+			if _, err := regexp.Compile(ptn); err != nil {
+				return fmt.Errorf("matchers.%s: %s", p[0], err)
+			}
+		}
+	}
+	if empty {
+		return errors.New("matchers: at least one matcher must be set")
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return errors.New("endsAt: must be after startsAt")
+	}
+	if s.Comment == "" {
+		return errors.New("comment: must be set")
+	}
+	return nil
+}
+
+func (s silence) match(event *v1.Event) bool {
+	targets := map[string]string{
+		"namespace": event.InvolvedObject.Namespace,
+		"kind":      event.InvolvedObject.Kind,
+		"name":      event.InvolvedObject.Name,
+		"reason":    event.Reason,
+		"type":      event.Type,
+	}
+	for _, p := range s.Matchers.pairs() {
+		if p[1] != "" && !matchExact(p[1], targets[p[0]]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchExact は完全一致か、`/regex/`なら全体がmatchするかどうか
+func matchExact(pattern string, target string) bool {
+	if ptn, ok := regexPattern(pattern); ok {
+		match, err := regexp.MatchString("^(?:"+ptn+")$", target)
+		return err == nil && match
+	}
+	return pattern == target
+}
+
+// silenceStore はsilenceを持ち、変更のたびにfileに書き出す
+type silenceStore struct {
+	mu       sync.RWMutex
+	silences map[string]silence
+	path     string
+}
+
+var silences = &silenceStore{silences: map[string]silence{}}
+
+// load はfileからsilenceを読み込む。fileがなければ空
+func (st *silenceStore) load(path string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.path = path
+	if path == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []silence
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	now := time.Now()
+	for _, s := range list {
+		if now.Before(s.EndsAt) {
+			st.silences[s.ID] = s
+		}
+	}
+	glog.Infof("%d silences loaded from %s", len(st.silences), path)
+	return nil
+}
+
+// save はtmp fileに書いてからrenameする。mu.Lockの中で呼ぶ
+func (st *silenceStore) save() error {
+	if st.path == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(st.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(st.path, buf)
+}
+
+// gc は期限切れのsilenceを消す。mu.Lockの中で呼ぶ
+func (st *silenceStore) gc(now time.Time) bool {
+	removed := false
+	for id, s := range st.silences {
+		if !now.Before(s.EndsAt) {
+			delete(st.silences, id)
+			removed = true
+		}
+	}
+	return removed
+}
+
+func (st *silenceStore) listLocked() []silence {
+	list := make([]silence, 0, len(st.silences))
+	for _, s := range st.silences {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartsAt.Before(list[j].StartsAt) || (list[i].StartsAt.Equal(list[j].StartsAt) && list[i].ID < list[j].ID)
+	})
+	return list
+}
+
+func (st *silenceStore) list() []silence {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.gc(time.Now()) {
+		if err := st.save(); err != nil {
+			glog.Errorf("Error save silences : %s\n", err)
+		}
+	}
+	return st.listLocked()
+}
+
+func (st *silenceStore) get(id string) (silence, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	s, ok := st.silences[id]
+	return s, ok
+}
+
+// add はsilenceを追加する。IDが既存のものなら置き換える
+func (st *silenceStore) add(s silence) (silence, error) {
+	if s.StartsAt.IsZero() {
+		s.StartsAt = time.Now()
+	}
+	if err := s.validate(); err != nil {
+		return s, err
+	}
+	if !time.Now().Before(s.EndsAt) {
+		return s, errors.New("endsAt: must be in the future")
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if s.ID == "" {
+		s.ID = newSilenceID()
+	} else if _, ok := st.silences[s.ID]; !ok {
+		return s, fmt.Errorf("silence %s not found", s.ID)
+	}
+	st.silences[s.ID] = s
+	st.gc(time.Now())
+	return s, st.save()
+}
+
+func (st *silenceStore) remove(id string) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.silences[id]; !ok {
+		return false, nil
+	}
+	delete(st.silences, id)
+	return true, st.save()
+}
+
+// silenced はeventにmatchする有効なsilenceのID
+func (st *silenceStore) silenced(event *v1.Event) (string, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	now := time.Now()
+	for _, s := range st.silences {
+		if s.active(now) && s.match(event) {
+			return s.ID, true
+		}
+	}
+	return "", false
+}
+
+// count は有効なsilenceの数。metricsで使う
+func (st *silenceStore) count() int {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	n := 0
+	now := time.Now()
+	for _, s := range st.silences {
+		if s.active(now) {
+			n++
+		}
+	}
+	return n
+}
+
+func newSilenceID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// isSilenced はsilencesが有効でeventにmatchするsilenceがあるかどうか
+func isSilenced(event *v1.Event, source string) bool {
+	if !*enableSilences {
+		return false
+	}
+	id, ok := silences.silenced(event)
+	if !ok {
+		return false
+	}
+	eventWatcherSilenced.WithLabelValues(source).Inc()
+	if glog.V(1) {
+		glog.Infof("Silenced by %s, %s/%s (%s)", id, event.Namespace, event.Name, source)
+	}
+	return true
+}
+
+// authorizeSilences は-silencesTokenFileが設定されていれば`Authorization: Bearer <token>`を確かめる
+// fileはmountしたSecretを想定していて、更新されたら読み直す
+func authorizeSilences(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *silencesTokenFile == "" {
+			h(w, r)
+			return
+		}
+		token, err := loadSecretFile(*silencesTokenFile).read()
+		if err != nil || token == "" {
+			glog.Errorf("Error read silences token file : %v\n", err)
+			writeError(w, http.StatusInternalServerError, errors.New("token is not available"))
+			return
+		}
+		got := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// silencesHandler は`/api/v1/silences`と`/api/v1/silences/<id>`
+//
+//	GET    /api/v1/silences      : 一覧
+//	POST   /api/v1/silences      : 作成。idを指定すると更新
+//	GET    /api/v1/silences/<id> : 取得
+//	DELETE /api/v1/silences/<id> : 削除
+func silencesHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, silencesPath), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, silences.list())
+	case id == "" && r.Method == http.MethodPost:
+		var s silence
+		d := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&s); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		s, err := silences.add(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		glog.Infof("silence %s saved : %+v", s.ID, s.Matchers)
+		writeJSON(w, http.StatusOK, s)
+	case id != "" && r.Method == http.MethodGet:
+		s, ok := silences.get(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("silence %s not found", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case id != "" && r.Method == http.MethodDelete:
+		ok, err := silences.remove(id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("silence %s not found", id))
+			return
+		}
+		glog.Infof("silence %s deleted", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed", r.Method))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Errorf("Error write response : %s\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -2,10 +2,16 @@ package watcher
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/slack-go/slack"
@@ -13,20 +19,92 @@ import (
 )
 
 const (
-	defaultNotifySlack = true
+	defaultNotifySlack     = true
+	defaultSlackMessageTTL = time.Hour
+)
+
+// slackUpdateに指定できる値
+const (
+	slackUpdateMessage = "update"
+	slackUpdateThread  = "thread"
 )
 
 var (
 	notifySlack       = flag.Bool("notifySlack", defaultNotifySlack, "Whether to notify events to Slack.")
 	slackTemplateFile = flag.String("slackTemplateFile", "", "Path of Slack template file.")
+	slackTokenFile    = flag.String("slackTokenFile", "", "Path of file containing Slack api token. Used instead of SLACK_TOKEN, and reloaded when the file is changed.")
+	slackMessageTTL   = flag.Duration("slackMessageTTL", defaultSlackMessageTTL, "How long to keep Slack messages of events to update them or reply in their threads.")
 )
 
 type slackConfig struct {
-	Token    string
-	Channel  string
-	Template *template.Template
+	NotifySlack bool
+	Token       string
+	TokenFile   *secretFile
+	Channel     string
+	Template    *template.Template
+	// Update は同じeventの2回目以降の送り方。""なら毎回post
+	Update string
+}
+
+// tokenRef はoutboxからtokenを参照するための名前。tokenそのものはdiskに書かない
+func (c slackConfig) tokenRef() string {
+	if c.TokenFile != nil {
+		return "file:" + c.TokenFile.path
+	}
+	sum := sha256.Sum256([]byte(c.Token))
+	ref := "token:" + hex.EncodeToString(sum[:8])
+	slackTokensMu.Lock()
+	slackTokens[ref] = c.Token
+	slackTokensMu.Unlock()
+	return ref
+}
+
+// slackTokens はtokenRefからtokenをひく。設定を読み込んだ時に登録される
+var (
+	slackTokensMu sync.Mutex
+	slackTokens   = map[string]string{}
+)
+
+// errSlackTokenNotFound はtokenRefのtokenが設定にない時のerror
+var errSlackTokenNotFound = errors.New("slack token not found in config")
+
+// registerSlackTokens はdefaultとentryのtokenを登録する
+func registerSlackTokens(conf []Config) {
+	defaultSlackConfig().tokenRef()
+	for _, cf := range conf {
+		defaultSlackConfig().withEntryToken(cf).tokenRef()
+	}
+}
+
+// resolveSlackToken はtokenRefのtoken
+func resolveSlackToken(ref string) (string, error) {
+	if strings.HasPrefix(ref, "file:") {
+		return loadSecretFile(strings.TrimPrefix(ref, "file:")).read()
+	}
+	slackTokensMu.Lock()
+	defer slackTokensMu.Unlock()
+	t, ok := slackTokens[ref]
+	if !ok {
+		return "", fmt.Errorf("%s: %w", ref, errSlackTokenNotFound)
+	}
+	return t, nil
+}
+
+// token はtoken fileの指定があればその中身、なければToken
+func (c slackConfig) token() string {
+	if c.TokenFile == nil {
+		return c.Token
+	}
+	t, err := c.TokenFile.read()
+	if err != nil {
+		glog.Errorf("error read slack token file : %s\n", err)
+	}
+	return t
 }
 
+// slackAPIURL はeventを送るSlack APIのURL。testではlocalのserverに向ける
+var slackAPIURL = slack.APIURL
+
 var slackColors = map[string]string{
 	"Normal":  "good",
 	"Warning": "warning",
@@ -45,10 +123,38 @@ reason: {{.Reason}}
 message: {{.Message}}
 count: {{.Count}}`
 
-func loadSlackConfig() slackConfig {
+var slackTplFuncs = map[string]interface{}{}
+
+// defaultSlackConfig は環境変数とflagで指定されたdefaultの設定
+func defaultSlackConfig() slackConfig {
 	c := slackConfBase
-	funcs := map[string]interface{}{}
-	c.Template = loadTemplate(slackDefTpl, *slackTemplateFile, funcs, v1.Event{})
+	if *slackTokenFile != "" {
+		c.TokenFile = loadSecretFile(*slackTokenFile)
+	}
+	return c
+}
+
+// withEntryToken はentryでtokenが指定されていればそれを使う
+func (c slackConfig) withEntryToken(cf Config) slackConfig {
+	if cf.SlackTokenFile != "" {
+		c.TokenFile = loadSecretFile(cf.SlackTokenFile)
+	} else if cf.SlackToken != "" {
+		c.Token = cf.SlackToken
+		c.TokenFile = nil
+	}
+	return c
+}
+
+func loadSlackConfig(cf Config) slackConfig {
+	c := defaultSlackConfig().withEntryToken(cf)
+	c.NotifySlack = *notifySlack && cf.useOutput(outputSlack)
+	if cf.Channel != "" {
+		c.Channel = cf.Channel
+	}
+	c.Update = cf.SlackUpdate
+	// outboxから送る時のためにtokenを登録しておく
+	c.tokenRef()
+	c.Template = loadEntryTemplate(slackDefTpl, cf.SlackTemplate, cf.SlackTemplateFile, *slackTemplateFile, slackTplFuncs, v1.Event{})
 	return c
 }
 
@@ -58,15 +164,16 @@ func ValidateSlack() error {
 		glog.Infof("disable notify Slack.\n")
 		return nil
 	}
-	if slackConfBase.Token == "" || slackConfBase.Channel == "" {
+	c := defaultSlackConfig()
+	if c.token() == "" || c.Channel == "" {
 		return errors.New("slack error: token or channel is empty")
 	}
-	glog.Infof("default slack channel: %v\n", slackConfBase.Channel)
-	api := slack.New(slackConfBase.Token)
+	glog.Infof("default slack channel: %v\n", c.Channel)
+	api := slack.New(c.token())
 	title := "kube-event-watcher"
 	text := "application start"
 	params := prepareParams(title, text, "good")
-	if _, _, e := api.PostMessage(slackConfBase.Channel, params...); e != nil {
+	if _, _, e := api.PostMessage(c.Channel, params...); e != nil {
 		return e
 	}
 	return nil
@@ -74,11 +181,12 @@ func ValidateSlack() error {
 
 func postExitMsg() {
 	if *notifySlack {
-		api := slack.New(slackConfBase.Token)
+		c := defaultSlackConfig()
+		api := slack.New(c.token())
 		title := "kube-event-watcher"
 		text := "application stop"
 		params := prepareParams(title, text, "good")
-		if _, _, e := api.PostMessage(slackConfBase.Channel, params...); e != nil {
+		if _, _, e := api.PostMessage(c.Channel, params...); e != nil {
 			glog.Errorf("error send shutdown message : %s\n", e)
 		}
 	}
@@ -110,36 +218,166 @@ func prepareSlackMessage(event v1.Event, tpl *template.Template) string {
 	return buf.String()
 }
 
-func postEventToSlack(obj interface{}, action string, status string, conf slackConfig) error {
-	if !*notifySlack {
-		return nil
-	}
-	api := slack.New(conf.Token)
-	title := "kubernetes event : " + action
+// slackPost はSlackに送るmessage。outboxに保存するのでtokenは持たずにtokenRefで参照する
+type slackPost struct {
+	Key      string `json:"key,omitempty"`
+	Update   string `json:"update,omitempty"`
+	Channel  string `json:"channel"`
+	Title    string `json:"title"`
+	Text     string `json:"text"`
+	Color    string `json:"color"`
+	TokenRef string `json:"tokenRef"`
+}
+
+// newSlackPost はeventか文字列からmessageを作る
+func newSlackPost(key string, obj interface{}, action string, status string, conf slackConfig) (slackPost, bool) {
 	color, ok := slackColors[status]
 	if !ok {
 		color = "danger"
 	}
-	var message string
+	p := slackPost{
+		Key:      key,
+		Update:   conf.Update,
+		Channel:  conf.Channel,
+		Title:    "kubernetes event : " + action,
+		Color:    color,
+		TokenRef: conf.tokenRef(),
+	}
 	switch e := obj.(type) {
 	case *v1.Event:
-		message = prepareSlackMessage(*e, conf.Template)
+		p.Text = prepareSlackMessage(*e, conf.Template)
 	case string:
-		message = e
+		p.Text = e
 	default:
 		glog.Errorf("Not supported type : %T\n", obj)
-		return nil
+		return p, false
 	}
-	params := prepareParams(title, message, color)
-	_, _, err := api.PostMessage(conf.Channel, params...)
+	return p, true
+}
+
+// postEventToSlack はSlackにpostして、postしたchannelのIDとmessageのtsを返す
+// optsでthreadへの返信（MsgOptionTS）やmessageの更新（MsgOptionUpdate）を指定する
+func postEventToSlack(p slackPost, token string, opts ...slack.MsgOption) (string, string, error) {
+	api := slack.New(token, slack.OptionAPIURL(slackAPIURL))
+	params := append(prepareParams(p.Title, p.Text, p.Color), opts...)
+	return postSlackMessage(api, p.Channel, params)
+}
+
+func postSlackMessage(api *slack.Client, channel string, params []slack.MsgOption) (string, string, error) {
+	ch, ts, err := api.PostMessage(channel, params...)
 	if err != nil {
 		if err.Error() == "channel_not_found" {
-			glog.Infof("error : channel %v not found, send message to default channel", conf.Channel)
-			_, _, err = api.PostMessage(conf.Channel, params...)
+			glog.Infof("error : channel %v not found, send message to default channel", channel)
+			ch, ts, err = api.PostMessage(channel, params...)
 		}
 		if err != nil {
+			return "", "", err
+		}
+	}
+	return ch, ts, nil
+}
+
+// postSlackSummary はrate limitで送れなかった数を送る
+func postSlackSummary(n int, conf slackConfig) {
+	api := slack.New(conf.token())
+	params := prepareParams("kubernetes event : rate limited", rateLimitMessage(n, outputSlack, conf.Channel), "warning")
+	if _, _, err := postSlackMessage(api, conf.Channel, params); err != nil {
+		glog.Errorf("Error post rate limit summary to slack : %s\n", err)
+	}
+}
+
+// sendToSlack はeventをSlackに送る。-outboxDirの指定があればoutboxに入れて、outboxから送る
+// keyはeventのnamespace/nameで、slackUpdateの指定がある時に使う
+func sendToSlack(key string, obj interface{}, action string, status string, conf slackConfig) error {
+	if !conf.NotifySlack {
+		return nil
+	}
+	p, ok := newSlackPost(key, obj, action, status, conf)
+	if !ok {
+		return nil
+	}
+	if deliveryOutbox != nil {
+		return deliveryOutbox.enqueue(outboxItem{Output: outputSlack, Slack: &p})
+	}
+	// rate limitで送れなかったものは数だけ後で送る
+	l := limiterFor(outputSlack, conf.Channel, *slackRateLimit, *slackRateBurst)
+	if !l.allow(func(n int) { postSlackSummary(n, conf) }) {
+		return nil
+	}
+	return deliverSlackPost(p, conf.token())
+}
+
+// deliverSlackPost はslackUpdateの指定に従って、同じeventの2回目以降を最初のmessageの更新かthreadへの返信にする
+func deliverSlackPost(p slackPost, token string) error {
+	if p.Update == "" || p.Key == "" {
+		_, _, err := postEventToSlack(p, token)
+		return err
+	}
+	if m, ok := slackMessages.get(p.Key); ok && m.requested == p.Channel {
+		c := p
+		c.Channel = m.channel
+		var opt slack.MsgOption
+		switch p.Update {
+		case slackUpdateMessage:
+			opt = slack.MsgOptionUpdate(m.ts)
+		case slackUpdateThread:
+			opt = slack.MsgOptionTS(m.ts)
+		}
+		if _, _, err := postEventToSlack(c, token, opt); err != nil {
 			return err
 		}
+		slackMessages.set(p.Key, m)
+		return nil
 	}
+	channel, ts, err := postEventToSlack(p, token)
+	if err != nil || ts == "" {
+		return err
+	}
+	slackMessages.set(p.Key, slackMessage{requested: p.Channel, channel: channel, ts: ts})
 	return nil
 }
+
+// slackMessage はeventの最初のmessage。requestedはpostした時に指定したchannel、channelはそのID
+type slackMessage struct {
+	requested string
+	channel   string
+	ts        string
+	expires   time.Time
+}
+
+// slackMessageCache はeventのkeyごとの最初のmessage。ttlを過ぎたら新しくpostする
+type slackMessageCache struct {
+	mu       sync.Mutex
+	messages map[string]slackMessage
+	lastGC   time.Time
+}
+
+var slackMessages = &slackMessageCache{messages: map[string]slackMessage{}}
+
+func (c *slackMessageCache) get(key string) (slackMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.messages[key]
+	if !ok || time.Now().After(m.expires) {
+		return m, false
+	}
+	return m, true
+}
+
+// set はmessageを記録してttlを延ばす。期限切れのものはttlごとに消す
+func (c *slackMessageCache) set(key string, m slackMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	m.expires = now.Add(*slackMessageTTL)
+	c.messages[key] = m
+	if now.Sub(c.lastGC) < *slackMessageTTL {
+		return
+	}
+	for k, v := range c.messages {
+		if now.After(v.expires) {
+			delete(c.messages, k)
+		}
+	}
+	c.lastGC = now
+}
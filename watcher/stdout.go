@@ -1,35 +1,169 @@
 package watcher
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/golang/glog"
 	v1 "k8s.io/api/core/v1"
 )
 
 const (
-	defaultPutStout = false
+	defaultPutStout     = false
+	defaultStdoutFormat = stdoutFormatRaw
+)
+
+// stdoutへの出力形式
+const (
+	stdoutFormatRaw      = "raw"
+	stdoutFormatJSON     = "json"
+	stdoutFormatECS      = "ecs"
+	stdoutFormatLogfmt   = "logfmt"
+	stdoutFormatTemplate = "template"
 )
 
 var (
-	putStdout = flag.Bool("putStdout", defaultPutStout, "Whether to output events to stdout.")
+	putStdout          = flag.Bool("putStdout", defaultPutStout, "Whether to output events to stdout.")
+	stdoutFormat       = flag.String("stdoutFormat", defaultStdoutFormat, "Output format of stdout. One of raw, json, ecs, logfmt, template.")
+	stdoutTemplateFile = flag.String("stdoutTemplateFile", "", "Path of stdout template file. Used when stdoutFormat is template.")
 )
 
-func putEventToStdout(obj interface{}) error {
+type stdoutConfig struct {
+	PutStdout bool
+	Format    string
+	Template  *template.Template
+}
+
+var stdoutDefTpl = `{{.Type}} {{.ObjectMeta.Namespace}} {{.InvolvedObject.Kind}}/{{.InvolvedObject.Name}} {{.Reason}}: {{.Message}} (count: {{.Count}})`
+
+// ecsVersion は出力するElastic Common Schemaのバージョン
+const ecsVersion = "1.12.0"
+
+type stdoutEvent struct {
+	Time           time.Time            `json:"time"`
+	Type           string               `json:"type"`
+	Reason         string               `json:"reason"`
+	Message        string               `json:"message"`
+	Count          int32                `json:"count"`
+	Namespace      string               `json:"namespace"`
+	Name           string               `json:"name"`
+	InvolvedObject stdoutInvolvedObject `json:"involvedObject"`
+	Source         stdoutSource         `json:"source"`
+	FirstTimestamp time.Time            `json:"firstTimestamp"`
+	LastTimestamp  time.Time            `json:"lastTimestamp"`
+}
+
+type stdoutInvolvedObject struct {
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	UID        string `json:"uid,omitempty"`
+	APIVersion string `json:"apiVersion,omitempty"`
+	FieldPath  string `json:"fieldPath,omitempty"`
+}
+
+type stdoutSource struct {
+	Component string `json:"component,omitempty"`
+	Host      string `json:"host,omitempty"`
+}
+
+type ecsEvent struct {
+	Timestamp    time.Time       `json:"@timestamp"`
+	Message      string          `json:"message"`
+	ECS          ecsVersionField `json:"ecs"`
+	Log          ecsLog          `json:"log"`
+	Event        ecsEventField   `json:"event"`
+	Orchestrator ecsOrchestrator `json:"orchestrator"`
+	Host         *ecsHost        `json:"host,omitempty"`
+	Labels       ecsLabels       `json:"labels"`
+}
+
+type ecsVersionField struct {
+	Version string `json:"version"`
+}
+
+type ecsLog struct {
+	Level  string `json:"level"`
+	Logger string `json:"logger,omitempty"`
+}
+
+type ecsEventField struct {
+	Kind     string    `json:"kind"`
+	Dataset  string    `json:"dataset"`
+	Provider string    `json:"provider,omitempty"`
+	Reason   string    `json:"reason"`
+	Created  time.Time `json:"created"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+}
+
+type ecsOrchestrator struct {
+	Type      string      `json:"type"`
+	Namespace string      `json:"namespace"`
+	Resource  ecsResource `json:"resource"`
+}
+
+type ecsResource struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+type ecsHost struct {
+	Name string `json:"name"`
+}
+
+type ecsLabels struct {
+	EventType  string `json:"event_type"`
+	EventCount int32  `json:"event_count"`
+	FieldPath  string `json:"field_path,omitempty"`
+	ObjectUID  string `json:"object_uid,omitempty"`
+}
+
+func loadStdoutConfig(cf Config) stdoutConfig {
+	c := stdoutConfig{
+		PutStdout: *putStdout && cf.useOutput(outputStdout),
+		Format:    *stdoutFormat,
+	}
+	if c.Format == stdoutFormatTemplate {
+		c.Template = loadTemplate(stdoutDefTpl, *stdoutTemplateFile, tplFuncs, v1.Event{})
+	}
+	return c
+}
+
+// ValidateStdout : 指定されたstdoutの出力形式が使用可能かどうか
+func ValidateStdout() error {
 	if !*putStdout {
 		return nil
 	}
+	switch *stdoutFormat {
+	case stdoutFormatRaw, stdoutFormatJSON, stdoutFormatECS, stdoutFormatLogfmt, stdoutFormatTemplate:
+	default:
+		return fmt.Errorf("stdout error: unknown format %q", *stdoutFormat)
+	}
+	glog.Infof("stdout format: %v\n", *stdoutFormat)
+	return nil
+}
+
+func putEventToStdout(obj interface{}, conf stdoutConfig) error {
+	if !conf.PutStdout {
+		return nil
+	}
 
 	switch e := obj.(type) {
 	case *v1.Event:
-		if msgBytes, err := json.Marshal(e); err == nil {
-			fmt.Fprintln(os.Stdout, string(msgBytes))
-		} else {
-			glog.Warningf("Failed to make json string: %v", err)
+		msg, err := formatStdoutEvent(e, conf)
+		if err != nil {
+			glog.Warningf("Failed to format event for stdout: %v", err)
+			return nil
 		}
+		fmt.Fprintln(os.Stdout, msg)
 	default:
 		glog.Errorf("Not supported type : %T\n", obj)
 		return nil
@@ -37,3 +171,146 @@ func putEventToStdout(obj interface{}) error {
 
 	return nil
 }
+
+func formatStdoutEvent(e *v1.Event, conf stdoutConfig) (string, error) {
+	switch conf.Format {
+	case stdoutFormatJSON:
+		return marshalString(normalizeEvent(e))
+	case stdoutFormatECS:
+		return marshalString(ecsFromEvent(e))
+	case stdoutFormatLogfmt:
+		return logfmtFromEvent(e), nil
+	case stdoutFormatTemplate:
+		var buf bytes.Buffer
+		if err := conf.Template.Execute(&buf, *e); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	default:
+		return marshalString(e)
+	}
+}
+
+func marshalString(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func normalizeEvent(e *v1.Event) stdoutEvent {
+	return stdoutEvent{
+		Time:      eventTime(e),
+		Type:      e.Type,
+		Reason:    e.Reason,
+		Message:   e.Message,
+		Count:     e.Count,
+		Namespace: e.ObjectMeta.Namespace,
+		Name:      e.ObjectMeta.Name,
+		InvolvedObject: stdoutInvolvedObject{
+			Kind:       e.InvolvedObject.Kind,
+			Namespace:  e.InvolvedObject.Namespace,
+			Name:       e.InvolvedObject.Name,
+			UID:        string(e.InvolvedObject.UID),
+			APIVersion: e.InvolvedObject.APIVersion,
+			FieldPath:  e.InvolvedObject.FieldPath,
+		},
+		Source: stdoutSource{
+			Component: e.Source.Component,
+			Host:      e.Source.Host,
+		},
+		FirstTimestamp: e.FirstTimestamp.Time.UTC(),
+		LastTimestamp:  e.LastTimestamp.Time.UTC(),
+	}
+}
+
+func ecsFromEvent(e *v1.Event) ecsEvent {
+	level := "info"
+	if e.Type == v1.EventTypeWarning {
+		level = "warning"
+	}
+	ev := ecsEvent{
+		Timestamp: eventTime(e),
+		Message:   e.Message,
+		ECS:       ecsVersionField{Version: ecsVersion},
+		Log: ecsLog{
+			Level:  level,
+			Logger: e.Source.Component,
+		},
+		Event: ecsEventField{
+			Kind:     "event",
+			Dataset:  "kubernetes.event",
+			Provider: e.Source.Component,
+			Reason:   e.Reason,
+			Created:  e.ObjectMeta.CreationTimestamp.Time.UTC(),
+			Start:    e.FirstTimestamp.Time.UTC(),
+			End:      e.LastTimestamp.Time.UTC(),
+		},
+		Orchestrator: ecsOrchestrator{
+			Type:      "kubernetes",
+			Namespace: e.ObjectMeta.Namespace,
+			Resource: ecsResource{
+				Type: strings.ToLower(e.InvolvedObject.Kind),
+				Name: e.InvolvedObject.Name,
+			},
+		},
+		Labels: ecsLabels{
+			EventType:  e.Type,
+			EventCount: e.Count,
+			FieldPath:  e.InvolvedObject.FieldPath,
+			ObjectUID:  string(e.InvolvedObject.UID),
+		},
+	}
+	if e.Source.Host != "" {
+		ev.Host = &ecsHost{Name: e.Source.Host}
+	}
+	return ev
+}
+
+func logfmtFromEvent(e *v1.Event) string {
+	pairs := [][2]string{
+		{"time", eventTime(e).Format(time.RFC3339)},
+		{"type", e.Type},
+		{"namespace", e.ObjectMeta.Namespace},
+		{"kind", e.InvolvedObject.Kind},
+		{"name", e.InvolvedObject.Name},
+		{"fieldPath", e.InvolvedObject.FieldPath},
+		{"reason", e.Reason},
+		{"count", strconv.Itoa(int(e.Count))},
+		{"component", e.Source.Component},
+		{"host", e.Source.Host},
+		{"message", e.Message},
+	}
+	var b strings.Builder
+	for i, p := range pairs {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(p[0])
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(p[1]))
+	}
+	return b.String()
+}
+
+func logfmtValue(v string) string {
+	if v == "" {
+		return `""`
+	}
+	if strings.ContainsAny(v, " =\"\t\r\n\\") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// eventTime は eventの発生時刻。lastTimestampがない(events.k8s.io由来の)場合はeventTimeを使う
+func eventTime(e *v1.Event) time.Time {
+	if !e.LastTimestamp.IsZero() {
+		return e.LastTimestamp.Time.UTC()
+	}
+	if !e.EventTime.IsZero() {
+		return e.EventTime.Time.UTC()
+	}
+	return e.ObjectMeta.CreationTimestamp.Time.UTC()
+}
@@ -1,13 +1,14 @@
 package watcher
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
-	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -36,8 +37,29 @@ type controller struct {
 	informer    cache.Controller
 	slackConf   slackConfig
 	logConf     cwLogConfig
+	stdoutConf  stdoutConfig
 	extraFilter extraFilter
+	routes      []route
+	schedules   []activeSchedule
+	aggregator  *aggregator
+	digest      *digestReport
+	escalations []*escalationCounter
+	flapping    *flappingDetector
 	startTime   time.Time
+	// source はcontrollerの設定entryを読み込んだfile
+	source string
+	// entry は設定entryの内容のhash。checkpointのkeyに使う
+	entry      string
+	namespaces *namespaceCache
+	// resumed はreloadで既存のcontrollerから引き継いだ場合。startTime以降に発生したeventを拾う
+	resumed bool
+	// endTime 以降に発生したeventは後継のcontrollerに任せる
+	endMu   sync.RWMutex
+	endTime time.Time
+	done    chan struct{}
+	// deliveries は送れなかった出力先が残っているevent。keyはeventのnamespace/name
+	deliveriesMu sync.Mutex
+	deliveries   map[string]*pendingDelivery
 }
 
 type event struct {
@@ -50,8 +72,7 @@ var (
 	kubeconfig = flag.String("kubeconfig", defaultKubeconfigPath, "Path to kubeconfig file. Generally use ServiceAccount in manifest, so don't need this.")
 )
 
-func kubeClient() kubernetes.Interface {
-	var ret kubernetes.Interface
+func kubeRestConfig() *rest.Config {
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		var kubeconfigPath string
@@ -71,23 +92,27 @@ func kubeClient() kubernetes.Interface {
 			panic(err)
 		}
 	}
-	ret, err = kubernetes.NewForConfig(config)
+	return config
+}
+
+func kubeClient(config *rest.Config) kubernetes.Interface {
+	ret, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		panic(err)
 	}
 	return ret
 }
 
-func newController(queue workqueue.RateLimitingInterface, indexer cache.Indexer, informer cache.Controller, slackConfig slackConfig, logConfig cwLogConfig, extraFilter extraFilter, startTime time.Time) *controller {
-	return &controller{
-		informer:    informer,
-		indexer:     indexer,
-		queue:       queue,
-		slackConf:   slackConfig,
-		logConf:     logConfig,
-		extraFilter: extraFilter,
-		startTime:   startTime,
-	}
+func (c *controller) setEndTime(t time.Time) {
+	c.endMu.Lock()
+	defer c.endMu.Unlock()
+	c.endTime = t
+}
+
+func (c *controller) handedOver(e *v1.Event) bool {
+	c.endMu.RLock()
+	defer c.endMu.RUnlock()
+	return !c.endTime.IsZero() && !e.LastTimestamp.Time.Before(c.endTime)
 }
 
 func (c *controller) processNextItem() bool {
@@ -97,13 +122,19 @@ func (c *controller) processNextItem() bool {
 		return false
 	}
 	defer c.queue.Done(ev)
-	err := c.processItem(ev.(event))
+	var err error
+	switch item := ev.(type) {
+	case retryItem:
+		err = c.retry(item)
+	case event:
+		err = c.processItem(item)
+	}
 	// Handle the error if something went wrong during the execution of the business logic
 	c.handleErr(err, ev)
 	return true
 }
 
-func (c *controller) processItem(ev event) error {
+func (c *controller) processItem(ev event) (err error) {
 	obj, _, err := c.indexer.GetByKey(ev.key)
 	if err != nil {
 		glog.Warningf("Fetching object with key %s from store failed with %v", ev.key, err)
@@ -119,61 +150,131 @@ func (c *controller) processItem(ev event) error {
 			}
 
 			//起動時に取得する既存のlistはskip
-			if assertedObj.ObjectMeta.CreationTimestamp.Sub(c.startTime).Seconds() < 0 {
+			if c.resumed {
+				if assertedObj.LastTimestamp.Time.Before(c.startTime) {
+					return nil
+				}
+			} else if deliveryCheckpoint == nil && assertedObj.ObjectMeta.CreationTimestamp.Sub(c.startTime).Seconds() < 0 {
+				return nil
+			}
+
+			//reloadで後継のcontrollerに引き継いだevent
+			if c.handedOver(assertedObj) {
 				return nil
 			}
 
-			//不定期に起こる謎のupdate(`resourceVersion for the provided watch is too old`)を排除するためlastTimestampから60秒以上はskip
-			if time.Now().Local().Unix()-assertedObj.LastTimestamp.Unix() > 60 {
+			if deliveryCheckpoint != nil {
+				//checkpointがあれば送ったeventとcatchUpWindowより前のeventだけskip
+				if !deliveryCheckpoint.pending(c.entry, assertedObj) {
+					return nil
+				}
+				defer func() {
+					if err == nil {
+						deliveryCheckpoint.done(c.entry, assertedObj)
+					}
+				}()
+			} else if time.Now().Local().Unix()-assertedObj.LastTimestamp.Unix() > 60 {
+				//不定期に起こる謎のupdate(`resourceVersion for the provided watch is too old`)を排除するためlastTimestampから60秒以上はskip
 				return nil
 			}
 
-			if exFiltering(assertedObj, c.extraFilter) {
+			//objectのannotationでの除外と強制通知
+			ignore, force := optOut(c.namespaces, assertedObj)
+			if ignore {
 				if glog.V(1) {
-					glog.Infof("Filtered by extra filters, %s", ev.key)
+					glog.Infof("Ignored by object annotation, %s (%s)", ev.key, c.source)
 				}
 				return nil
 			}
-			if glog.V(1) {
-				glog.Infof("Send notify, %s", ev.key)
+
+			//escalationはextraFilterなどとは別に数える
+			for _, ec := range c.escalations {
+				ec.add(assertedObj)
 			}
 
-			if e := putEventToStdout(assertedObj); e != nil {
-				glog.Errorf("Error put event to stdout : %s \n", e)
+			//flapping中のobjectのeventはflappingの通知にまとめる
+			quiet := func() bool { return c.quiet(assertedObj, force) }
+			if c.flapping.observe(assertedObj, quiet) && !force {
+				if glog.V(1) {
+					glog.Infof("Suppressed by flapping, %s (%s)", ev.key, c.source)
+				}
+				return nil
 			}
 
-			switch ev.eventType {
-			case "ADDED":
-				setPromMetrics(assertedObj)
-				if e := postEventToSlack(assertedObj, "created", assertedObj.Type, c.slackConf); e != nil {
-					return e
+			if !force && exFiltering(assertedObj, c.extraFilter) {
+				if glog.V(1) {
+					glog.Infof("Filtered by extra filters, %s (%s)", ev.key, c.source)
 				}
-				if e := postEventToCWLogs(assertedObj, "created", c.logConf); e != nil {
-					//cwlogsのエラーはreturnしない（retryしない）
-					glog.Errorf("Error send cloudwatch logs : %s \n", e)
+				return nil
+			}
+			sc, lc := routeByRules(assertedObj, c.routes, c.slackConf, c.logConf)
+			sc, lc, mute := routeByNamespace(c.namespaces, assertedObj.ObjectMeta.Namespace, sc, lc)
+			if mute && !force {
+				if glog.V(1) {
+					glog.Infof("Muted by namespace annotation, %s (%s)", ev.key, c.source)
 				}
 				return nil
-			case "MODIFIED":
-				setPromMetrics(assertedObj)
-				if e := postEventToSlack(assertedObj, "updated", assertedObj.Type, c.slackConf); e != nil {
-					return e
+			}
+			if isSilenced(assertedObj, c.source) {
+				return nil
+			}
+			if !force {
+				switch scheduleAction(c.schedules, assertedObj, time.Now()) {
+				case scheduleSuppress:
+					if glog.V(1) {
+						glog.Infof("Suppressed by schedule, %s (%s)", ev.key, c.source)
+					}
+					return nil
+				case scheduleLogOnly:
+					sc.NotifySlack = false
 				}
-				if e := postEventToCWLogs(assertedObj, "updated", c.logConf); e != nil {
-					glog.Errorf("Error send cloudwatch logs : %s \n", e)
+			}
+			if c.digest != nil {
+				c.digest.add(assertedObj)
+				if !c.digest.conf.KeepRealtime {
+					return nil
 				}
-				return nil
+			}
+			if glog.V(1) {
+				glog.Infof("Send notify, %s (%s)", ev.key, c.source)
+			}
+			eventWatcherNotifications.WithLabelValues(c.source).Inc()
+
+			if e := putEventToStdout(assertedObj, c.stdoutConf); e != nil {
+				glog.Errorf("Error put event to stdout : %s \n", e)
+			}
+
+			var action string
+			switch ev.eventType {
+			case "ADDED":
+				action = "created"
+			case "MODIFIED":
+				action = "updated"
 			default:
 				return nil
 			}
+			setPromMetrics(assertedObj)
+			//出力先ごとに送って、失敗した出力先だけ送り直す
+			p := newPendingDelivery(ev, assertedObj)
+			if !c.aggregator.add(assertedObj, sc) {
+				p.add(outputSlack, sc.Update == slackUpdateMessage, func() error { return sendToSlack(ev.key, assertedObj, action, assertedObj.Type, sc) })
+			}
+			p.add(outputCWLogs, false, func() error { return postEventToCWLogs(assertedObj, action, lc) })
+			c.replaceDelivery(p)
+			return c.deliver(p)
 		}
 		//case "DELETED"
-		if e := postEventToSlack(fmt.Sprintf("Event %s has been deleted.", ev.key), "deleted", "Danger", c.slackConf); e != nil {
-			return e
+		namespace, _, _ := cache.SplitMetaNamespaceKey(ev.key)
+		sc, lc, mute := routeByNamespace(c.namespaces, namespace, c.slackConf, c.logConf)
+		if mute {
+			return nil
 		}
-		if e := postEventToCWLogs(fmt.Sprintf("Event %s has been deleted.", ev.key), "deleted", c.logConf); e != nil {
-			glog.Errorf("Error send cloudwatch logs : %s \n", e)
-		}
-		return nil
+		msg := fmt.Sprintf("Event %s has been deleted.", ev.key)
+		p := newPendingDelivery(ev, nil)
+		p.add(outputSlack, sc.Update == slackUpdateMessage, func() error { return sendToSlack(ev.key, msg, "deleted", "Danger", sc) })
+		p.add(outputCWLogs, false, func() error { return postEventToCWLogs(msg, "deleted", lc) })
+		c.replaceDelivery(p)
+		return c.deliver(p)
 	}
 	return nil
 }
@@ -185,6 +286,15 @@ func (c *controller) handleErr(err error, key interface{}) {
 		return
 	}
 
+	//送れなかった出力先だけ、出力先ごとのretryの間隔の後に送り直す
+	var de *deliveryError
+	if errors.As(err, &de) {
+		glog.Errorf("Error delivering Event %v: %v", key, err)
+		c.queue.Forget(key)
+		c.queue.AddAfter(de.item, de.retryAfter)
+		return
+	}
+
 	if c.queue.NumRequeues(key) < maxRetries {
 		glog.Errorf("Error syncing Event %v: %v", key, err)
 		c.queue.AddRateLimited(key)
@@ -198,6 +308,8 @@ func (c *controller) handleErr(err error, key interface{}) {
 
 func (c *controller) run(stopCh chan struct{}) {
 	defer runtime.HandleCrash()
+	defer close(c.done)
+	defer c.release()
 	defer c.queue.ShutDown()
 	glog.Infoln("Starting Event controller")
 
@@ -213,6 +325,32 @@ func (c *controller) run(stopCh chan struct{}) {
 
 	<-stopCh
 	glog.Infoln("Stopping Event controller")
+	// queueに残っているeventは送ってから止める
+	c.queue.ShutDownWithDrain()
+	c.aggregator.stop()
+}
+
+// quiet はnamespaceのmute、silence、scheduleのsuppressで通知しないeventかどうか。metricsは数えない
+func (c *controller) quiet(e *v1.Event, force bool) bool {
+	if *enableSilences {
+		if _, ok := silences.silenced(e); ok {
+			return true
+		}
+	}
+	if force {
+		return false
+	}
+	if _, _, mute := routeByNamespace(c.namespaces, e.Namespace, c.slackConf, c.logConf); mute {
+		return true
+	}
+	return scheduleAction(c.schedules, e, time.Now()) == scheduleSuppress
+}
+
+// release はcontrollerが共有しているdigest、escalation、flappingの参照を返す
+func (c *controller) release() {
+	c.digest.release()
+	releaseEscalations(c.escalations)
+	c.flapping.release()
 }
 
 func (c *controller) runWorker() {
@@ -242,36 +380,95 @@ func makeFieldSelector(conf []fieldSelector) fields.Selector {
 	return fields.AndSelectors(selectors...)
 }
 
+func newWatch(client kubernetes.Interface, namespaces *namespaceCache, cf Config, entry string, startTime time.Time, resumed bool) *controller {
+	fieldSelector := makeFieldSelector(cf.FieldSelectors)
+	eventListWatcher := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "events", cf.Namespace, fieldSelector)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	indexer, informer := cache.NewIndexerInformer(eventListWatcher, &v1.Event{}, 0, resourceEventHandlerFuncs(queue, cf.WatchEvent), cache.Indexers{})
+	sc := loadSlackConfig(cf)
+	lc := loadCWLogConfig(cf)
+
+	c := &controller{
+		informer:    informer,
+		indexer:     indexer,
+		queue:       queue,
+		slackConf:   sc,
+		logConf:     lc,
+		stdoutConf:  loadStdoutConfig(cf),
+		extraFilter: cf.ExtraFilter,
+		routes:      cf.Routes,
+		schedules:   compileSchedules(cf.Schedules),
+		aggregator:  newAggregator(cf.Aggregation),
+		digest:      digestFor(cf, sc),
+		escalations: escalationsFor(cf),
+		flapping:    flappingFor(cf, sc, lc),
+		startTime:   startTime,
+		resumed:     resumed,
+		source:      cf.Source,
+		entry:       entry,
+		namespaces:  namespaces,
+		done:        make(chan struct{}),
+		deliveries:  map[string]*pendingDelivery{},
+	}
+	if c.aggregator != nil {
+		c.aggregator.deliver = c.deliverLater
+	}
+	return c
+}
+
 // WatchStart : eventをwatchするためのmain function
 func WatchStart(appConfig []Config) {
-	client := kubeClient()
-	for _, cf := range appConfig {
-		fieldSelector := makeFieldSelector(cf.FieldSelectors)
-		eventListWatcher := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "events", cf.Namespace, fieldSelector)
-		queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
-		indexer, informer := cache.NewIndexerInformer(eventListWatcher, &v1.Event{}, 0, resourceEventHandlerFuncs(queue, cf.WatchEvent), cache.Indexers{})
-		sc := loadSlackConfig()
-		if cf.Channel != "" {
-			sc.Channel = cf.Channel
-		}
-		lc := loadCWLogConfig()
-		if cf.LogStream != "" {
-			lc.CWLogStream = cf.LogStream
-		}
-		st := time.Now().Local()
-		ef := cf.ExtraFilter
-
-		controller := newController(queue, indexer, informer, sc, lc, ef, st)
-		stop := make(chan struct{})
-		defer close(stop)
-		go controller.run(stop)
+	restConfig := kubeRestConfig()
+	client := kubeClient(restConfig)
+	namespaces := newNamespaceCache(client)
+	defer namespaces.stop()
+	m := newWatchManager(client, namespaces)
+	if *namespaceAnnotations || *objectAnnotations {
+		namespaces.start()
+	}
+	if objectMetadataEnabled() {
+		startObjectMetaCache(restConfig)
+		defer stopObjectMetaCache()
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := startCheckpoint(client, stopCh); err != nil {
+		panic(err)
+	}
+	// controllerを止めてから最後のcheckpointを書き出す
+	defer deliveryCheckpoint.flush()
+	if err := startOutbox(appConfig); err != nil {
+		panic(err)
+	}
+	// controllerを止めてからoutboxのworkerを止める
+	defer deliveryOutbox.stop()
+	m.setFileConfig(appConfig, fingerprintTemplates())
+	initReloadMetrics()
+	defer m.stopAll()
+
+	reloadCh := make(chan struct{}, 1)
+	go watchConfigFiles(m.watchedFiles, reloadCh, stopCh)
+	if *watchRules {
+		go newRuleController(dynamicClient(restConfig), m).run(stopCh)
 	}
 
 	defer postExitMsg()
 	sigterm := make(chan os.Signal, 1)
 	signal.Notify(sigterm, syscall.SIGTERM)
 	signal.Notify(sigterm, syscall.SIGINT)
-	<-sigterm
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for {
+		select {
+		case <-sighup:
+			glog.Infoln("SIGHUP received, reload config")
+			m.reload()
+		case <-reloadCh:
+			m.reload()
+		case <-sigterm:
+			return
+		}
+	}
 }
 
 func resourceEventHandlerFuncs(queue workqueue.RateLimitingInterface, we watchEvent) cache.ResourceEventHandlerFuncs {
@@ -311,73 +508,51 @@ func resourceEventHandlerFuncs(queue workqueue.RateLimitingInterface, we watchEv
 
 // return trueで通知がスキップされる
 func exFiltering(event *v1.Event, exFilter extraFilter) bool {
-	if len(exFilter.Filters) == 0 {
-		return false
-	}
-	andCondCnt := 0
-	andMatchCnt := 0
-	for _, f := range exFilter.Filters {
-		if f.Condition == "and" {
-			andCondCnt++
-		}
-	}
 	const (
 		toKeep = "keep"
 		toDrop = "drop"
 	)
-	for _, f := range exFilter.Filters {
-		v := reflect.ValueOf(event).Elem()
-		for _, k := range strings.Split(f.Key, ".") {
-			v = v.FieldByName(k)
-			if !v.IsValid() {
-				break
-			}
-			if v.Kind() == reflect.Struct {
-				continue
-			}
-			if v.Kind() != reflect.String {
-				break
-			}
-			if matchString(f.Value, v.String()) {
-				switch exFilter.Type {
-				case toKeep:
-					if f.Condition != "and" {
-						return false
-					}
-					andMatchCnt++
-					if andMatchCnt == andCondCnt {
-						return false
-					}
-					continue
-				case toDrop:
-					if f.Condition != "and" {
-						return true
-					}
-					andMatchCnt++
-					if andMatchCnt == andCondCnt {
-						return true
-					}
-					continue
-				default:
-					break
-				}
-			}
-		}
+	root := exFilter.tree()
+	if root == nil {
+		return false
 	}
-	// マッチしなかった時の分岐
 	switch exFilter.Type {
 	case toKeep:
-		return true
+		return !root.eval(event)
 	case toDrop:
-		return false
+		return root.eval(event)
 	default:
 		return false
 	}
 }
 
-func matchString(pattern string, target string) bool {
+// routeByRules は最初にmatchしたrouteでchannelとlogStreamを上書きする
+func routeByRules(event *v1.Event, routes []route, sc slackConfig, lc cwLogConfig) (slackConfig, cwLogConfig) {
+	for _, r := range routes {
+		if !r.Match.eval(event) {
+			continue
+		}
+		if r.Channel != "" {
+			sc.Channel = r.Channel
+		}
+		if r.LogStream != "" {
+			lc.CWLogStream = r.LogStream
+		}
+		break
+	}
+	return sc, lc
+}
+
+// regexPattern は `/regex/` 形式ならその中身を返す
+func regexPattern(pattern string) (string, bool) {
 	if strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
-		ptn := strings.TrimSuffix(strings.TrimPrefix(pattern, "/"), "/")
+		return strings.TrimSuffix(strings.TrimPrefix(pattern, "/"), "/"), true
+	}
+	return "", false
+}
+
+func matchString(pattern string, target string) bool {
+	if ptn, ok := regexPattern(pattern); ok {
 		glog.Infoln("use regexp match")
 		match, err := regexp.MatchString(ptn, target)
 		if match {